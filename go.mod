@@ -3,7 +3,7 @@ module github.com/flachnetz/alwaysprofile
 go 1.12
 
 require (
-	github.com/flachnetz/go-forceexport v1.0.0
 	github.com/google/uuid v1.1.1
 	github.com/huandu/go-tls v0.0.0-20190320055402-ef90f27f86a2
+	github.com/klauspost/compress v1.9.8
 )
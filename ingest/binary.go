@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"time"
+)
+
+// content type of profiles in the binary format, see
+// pprof/sender/binary.go in the agent for a description.
+const contentTypeBinary = "application/x-alwaysprofile-v2"
+
+// the prefix of the content types of all versions of the binary format.
+// Profiles of other versions are decoded too, to fail with a clear error.
+const contentTypeBinaryPrefix = "application/x-alwaysprofile-"
+
+var binaryMagic = []byte("APB2")
+
+// the prefix of the magic bytes of all versions of the binary format.
+var binaryMagicPrefix = []byte("APB")
+
+// ids of the optional sections of a binary profile.
+const (
+	binarySectionMetrics = 1
+	binarySectionSpans   = 2
+	binarySectionLost    = 3
+	binarySectionDrift   = 4
+	binarySectionNames   = 5
+)
+
+// decodeBinaryProfile decodes a profile in the compact binary format.
+func decodeBinaryProfile(payload []byte) (Profile, error) {
+	var profile Profile
+
+	if !bytes.HasPrefix(payload, binaryMagic) {
+		if bytes.HasPrefix(payload, binaryMagicPrefix) && len(payload) >= len(binaryMagic) {
+			return profile, errors.Errorf("unsupported binary format %q, expected %q",
+				payload[:len(binaryMagic)], binaryMagic)
+		}
+
+		return profile, errors.New("invalid magic bytes")
+	}
+
+	r := binaryReader{r: bytes.NewReader(payload[len(binaryMagic):])}
+
+	profile.Type = r.ReadString()
+	profile.ServiceName = r.ReadString()
+	profile.Start = time.Unix(0, r.ReadVarint())
+
+	if _, err := io.ReadFull(r.r, profile.InstanceId[:]); err != nil {
+		return profile, errors.WithMessage(err, "read instance id")
+	}
+
+	profile.Tags = r.ReadStringMap()
+	profile.ValueTypes = r.ReadStrings()
+	profile.Names = r.ReadStrings()
+	profile.Files = r.ReadStrings()
+
+	lineCount := r.ReadCount()
+	for idx := 0; idx < lineCount; idx++ {
+		profile.Lines = append(profile.Lines, int32(r.ReadVarint()))
+	}
+
+	profile.DroppedProfiles = int(r.ReadUvarint())
+	profile.Goroutines = int(r.ReadUvarint())
+
+	kinds := r.ReadStrings()
+
+	labelSets := make([]map[string]string, r.ReadCount())
+	for idx := range labelSets {
+		labelSets[idx] = r.ReadStringMap()
+	}
+
+	stacks := make([][]int32, r.ReadCount())
+	for idx := range stacks {
+		stack := make([]int32, r.ReadCount())
+		for frameIdx := range stack {
+			// the range is checked against the known methods of the instance
+			methodId := r.ReadUvarint()
+			if methodId > math.MaxInt32 {
+				return profile, errors.Errorf("method id %d out of range", methodId)
+			}
+
+			stack[frameIdx] = int32(methodId)
+		}
+
+		stacks[idx] = stack
+	}
+
+	sampleCount := r.ReadCount()
+
+	timestamp := profile.Start.UnixNano()
+	for idx := 0; idx < sampleCount && r.err == nil; idx++ {
+		var sample Sample
+
+		timestamp += r.ReadVarint()
+		sample.TimestampNs = timestamp
+		sample.DurationNs = r.ReadVarint()
+
+		kindIdx := r.ReadUvarint()
+		stackIdx := r.ReadUvarint()
+		labelSetIdx := r.ReadUvarint()
+
+		if kindIdx >= uint64(len(kinds)) || stackIdx >= uint64(len(stacks)) || labelSetIdx > uint64(len(labelSets)) {
+			return profile, errors.New("sample references unknown table entry")
+		}
+
+		sample.Kind = kinds[kindIdx]
+		sample.Stack = stacks[stackIdx]
+
+		// a label set index of zero means no labels
+		if labelSetIdx > 0 {
+			sample.Labels = labelSets[labelSetIdx-1]
+		}
+
+		valueCount := r.ReadCount()
+		for valueIdx := 0; valueIdx < valueCount; valueIdx++ {
+			sample.Values = append(sample.Values, r.ReadVarint())
+		}
+
+		profile.Samples = append(profile.Samples, sample)
+	}
+
+	// optional sections until the end of the payload
+	for r.err == nil && r.r.Len() > 0 {
+		id := r.ReadUvarint()
+
+		payload := make([]byte, r.ReadCount())
+		if _, err := io.ReadFull(r.r, payload); err != nil && r.err == nil {
+			r.err = err
+		}
+
+		section := binaryReader{r: bytes.NewReader(payload)}
+
+		switch id {
+		case binarySectionMetrics:
+			profile.Metrics = &RuntimeMetrics{
+				HeapInUse:    int64(section.ReadUvarint()),
+				HeapAlloc:    int64(section.ReadUvarint()),
+				HeapObjects:  int64(section.ReadUvarint()),
+				NumGC:        int64(section.ReadUvarint()),
+				PauseTotalNs: int64(section.ReadUvarint()),
+				Goroutines:   int32(section.ReadUvarint()),
+				GOMAXPROCS:   int32(section.ReadUvarint()),
+			}
+
+		case binarySectionSpans:
+			spanCount := section.ReadCount()
+			for idx := 0; idx < spanCount && section.err == nil; idx++ {
+				profile.Spans = append(profile.Spans, SpanRecord{
+					Name:       section.ReadString(),
+					TraceId:    section.ReadString(),
+					SpanId:     section.ReadString(),
+					StartNs:    section.ReadVarint(),
+					DurationNs: section.ReadVarint(),
+				})
+			}
+
+		case binarySectionLost:
+			profile.LostSamples = int(section.ReadUvarint())
+
+		case binarySectionDrift:
+			profile.ClockDriftNs = section.ReadVarint()
+
+		case binarySectionNames:
+			profile.NamesOffset = int(section.ReadUvarint())
+
+		default:
+			// skip unknown sections of newer agents
+		}
+
+		if section.err != nil && r.err == nil {
+			r.err = errors.WithMessagef(section.err, "section %d", id)
+		}
+	}
+
+	return profile, errors.WithMessage(r.err, "decode binary profile")
+}
+
+// binaryReader reads varint encoded values. After the first error,
+// all reads return zero values and the error is kept in err.
+type binaryReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *binaryReader) ReadUvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	value, err := binary.ReadUvarint(r.r)
+	r.err = err
+	return value
+}
+
+func (r *binaryReader) ReadVarint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	value, err := binary.ReadVarint(r.r)
+	r.err = err
+	return value
+}
+
+// ReadCount reads the number of elements of a list. As each element needs
+// at least one byte, the count can not be larger than the remaining bytes.
+func (r *binaryReader) ReadCount() int {
+	count := r.ReadUvarint()
+	if count > uint64(r.r.Len()) {
+		if r.err == nil {
+			r.err = errors.New("count exceeds payload size")
+		}
+
+		return 0
+	}
+
+	return int(count)
+}
+
+func (r *binaryReader) ReadString() string {
+	length := r.ReadCount()
+	if r.err != nil {
+		return ""
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		r.err = err
+		return ""
+	}
+
+	return string(buf)
+}
+
+func (r *binaryReader) ReadStrings() []string {
+	values := make([]string, r.ReadCount())
+	for idx := range values {
+		values[idx] = r.ReadString()
+	}
+
+	return values
+}
+
+func (r *binaryReader) ReadStringMap() map[string]string {
+	count := r.ReadCount()
+
+	values := make(map[string]string, count)
+	for idx := 0; idx < count; idx++ {
+		key := r.ReadString()
+		values[key] = r.ReadString()
+	}
+
+	return values
+}
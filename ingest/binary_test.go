@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// encoded by the tests of the agent in pprof/sender, so
+// this checks that both sides agree on the format.
+var binaryTestdata = filepath.Join("..", "pprof", "sender", "testdata", "profile.bin")
+
+func TestDecodeBinaryProfile(t *testing.T) {
+	payload, err := ioutil.ReadFile(binaryTestdata)
+	if err != nil {
+		t.Fatalf("read testdata: %s", err)
+	}
+
+	profile, err := decodeBinaryProfile(payload)
+	if err != nil {
+		t.Fatalf("decode profile: %s", err)
+	}
+
+	start := time.Unix(1500000000, 0)
+	if !profile.Start.Equal(start) {
+		t.Errorf("expected start %s, got %s", start, profile.Start)
+	}
+
+	labels := map[string]string{"span": "request", "span_id": "42"}
+
+	expected := Profile{
+		Type:        "cpu",
+		Start:       profile.Start,
+		ServiceName: "service",
+		InstanceId:  uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef"),
+		Tags:        map[string]string{"region": "eu", "version": "1.0"},
+
+		ValueTypes:  []string{},
+		Names:       []string{"main.work", "main.wait"},
+		NamesOffset: 1,
+		Files:       []string{"main.go", "wait.go"},
+		Lines:       []int32{20, 30},
+
+		Samples: []Sample{
+			{
+				TimestampNs: start.Add(10 * time.Millisecond).UnixNano(),
+				DurationNs:  int64(10 * time.Millisecond),
+				Stack:       []int32{0, 1},
+				Labels:      labels,
+				Kind:        "cpu",
+			},
+			{
+				TimestampNs: start.Add(5 * time.Millisecond).UnixNano(),
+				DurationNs:  int64(20 * time.Millisecond),
+				Stack:       []int32{0, 2},
+				Kind:        "offcpu",
+			},
+			{
+				TimestampNs: start.Add(30 * time.Millisecond).UnixNano(),
+				DurationNs:  int64(10 * time.Millisecond),
+				Stack:       []int32{0, 1},
+				Labels:      labels,
+				Kind:        "cpu",
+			},
+		},
+
+		DroppedProfiles: 2,
+		LostSamples:     3,
+		ClockDriftNs:    int64(-4 * time.Millisecond),
+
+		Metrics: &RuntimeMetrics{
+			HeapInUse:    1000,
+			HeapAlloc:    800,
+			HeapObjects:  50,
+			NumGC:        7,
+			PauseTotalNs: int64(time.Millisecond),
+			Goroutines:   12,
+			GOMAXPROCS:   4,
+		},
+
+		Spans: []SpanRecord{
+			{
+				Name:       "request",
+				TraceId:    "trace",
+				SpanId:     "42",
+				StartNs:    start.Add(time.Millisecond).UnixNano(),
+				DurationNs: int64(40 * time.Millisecond),
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(expected, profile) {
+		t.Errorf("decoded profile differs\nexpected: %+v\n     got: %+v", expected, profile)
+	}
+}
+
+func TestDecodeBinaryProfileTruncated(t *testing.T) {
+	payload, err := ioutil.ReadFile(binaryTestdata)
+	if err != nil {
+		t.Fatalf("read testdata: %s", err)
+	}
+
+	// the optional sections at the end can be missing, but
+	// a profile cut off within the samples must fail.
+	for length := 0; length < len(payload); length++ {
+		_, err := decodeBinaryProfile(payload[:length])
+		if err == nil && length < len(payload)/2 {
+			t.Errorf("expected profile truncated to %d bytes to fail", length)
+		}
+	}
+}
+
+func TestDecodeBinaryProfileGarbage(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":         {},
+		"invalid magic": []byte("JSON{}"),
+		"older version": []byte("APB1\x03cpu"),
+		"huge count":    append(append([]byte(nil), binaryMagic...), 0x03, 'c', 'p', 'u', 0xff, 0xff, 0xff, 0xff, 0x0f),
+	}
+
+	for name, input := range inputs {
+		if _, err := decodeBinaryProfile(input); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
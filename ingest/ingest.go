@@ -29,7 +29,7 @@ type Ingester struct {
 	db *sqlx.DB
 
 	methodCacheLock sync.Mutex
-	methodCache     map[string]int32
+	methodCache     map[MethodKey]int32
 
 	stackCacheLock sync.Mutex
 	stackCache     map[int64]existsValue
@@ -39,54 +39,112 @@ type Ingester struct {
 
 	instanceCacheLock sync.Mutex
 	instanceCache     map[uuid.UUID]int32
+
+	// the global method ids of each instance, indexed by the
+	// method ids of the agent, see instanceMethodIds.
+	instanceMethodCacheLock    sync.Mutex
+	instanceMethodCache        map[int32]instanceMethods
+	instanceMethodCacheEvicted time.Time
 }
 
 func NewIngester(db *sqlx.DB) *Ingester {
 	return &Ingester{
 		db: db,
 
-		methodCache:   map[string]int32{},
+		methodCache:   map[MethodKey]int32{},
 		stackCache:    map[int64]existsValue{},
 		serviceCache:  map[string]int32{},
 		instanceCache: map[uuid.UUID]int32{},
+
+		instanceMethodCache: map[int32]instanceMethods{},
 	}
 }
 
+// MethodKey identifies a method, or a line within a method
+// if the profile contains file and line information.
+type MethodKey struct {
+	Name string `db:"name"`
+	File string `db:"file"`
+	Line int32  `db:"line"`
+}
+
 type Stack struct {
 	Id      int64
 	Methods []int32
 }
 
-func (ingester *Ingester) Ingest(ctx context.Context, profile Profile) error {
-	type SampleKey struct {
-		Timeslot   int32
-		InstanceId int32
-	}
+// Ingest stores the profile. It returns the number of method names
+// of the instance that are known after the profile was stored.
+func (ingester *Ingester) Ingest(ctx context.Context, profile Profile) (IngestResult, error) {
+	var result IngestResult
+
+	// the method ids of the instance, cached after the commit
+	var instanceId int32
+	var instanceMethodIds []int32
 
-	return WithTransactionContext(ctx, ingester.db, func(ctx context.Context, tx *sqlx.Tx) error {
+	err := WithTransactionContext(ctx, ingester.db, func(ctx context.Context, tx *sqlx.Tx) error {
 		serviceId, err := ingester.serviceId(ctx, profile.ServiceName)
 		if err != nil {
 			return errors.WithMessage(err, "ensure service exists")
 		}
 
-		instanceId, err := ingester.instanceId(ctx, serviceId, profile.InstanceId, profile.Tags)
+		// the tags of an instance are only stored once, so profiles recorded
+		// during a burst keep their marker as a label of each sample.
+		tags, burst := withoutKey(profile.Tags, burstTag)
+		if burst != "" {
+			for idx := range profile.Samples {
+				profile.Samples[idx].Labels = withLabel(profile.Samples[idx].Labels, burstTag, burst)
+			}
+		}
+
+		instanceId, err = ingester.instanceId(ctx, serviceId, profile.InstanceId, tags)
 		if err != nil {
 			return errors.WithMessage(err, "ensure instance exists")
 		}
 
+		var ok bool
+		instanceMethodIds, ok, err = ingester.instanceMethodIds(ctx, instanceId, profile)
+		if err != nil {
+			return errors.WithMessage(err, "lookup methods of instance")
+		}
+
+		result.KnownNames = len(instanceMethodIds)
+
+		if !ok {
+			// the agent needs to send the names we do not know
+			logrus.Infof("Instance %s of service %s sent %d names starting at %d, but only %d are known",
+				profile.InstanceId, profile.ServiceName, len(profile.Names), profile.NamesOffset, result.KnownNames)
+
+			return nil
+		}
+
+		if profile.DroppedProfiles > 0 {
+			logrus.Warnf("Instance %s of service %s dropped %d profiles",
+				profile.InstanceId, profile.ServiceName, profile.DroppedProfiles)
+		}
+
+		if profile.LostSamples > 0 {
+			logrus.Warnf("Instance %s of service %s lost %d samples",
+				profile.InstanceId, profile.ServiceName, profile.LostSamples)
+		}
+
+		if drift := time.Duration(profile.ClockDriftNs); drift > time.Second || drift < -time.Second {
+			logrus.Warnf("Clock of instance %s of service %s drifted by %s",
+				profile.InstanceId, profile.ServiceName, drift)
+		}
+
 		var stacks []Stack
 
 		for _, sample := range profile.Samples {
 			// transform local method ids into a list of global method ids.
 			var methodIds []int32
 			for _, frame := range sample.Stack {
-				methodId, err := ingester.methodId(ctx, profile.Names[frame])
-				if err != nil {
-					return errors.WithMessage(err, "lookup method")
+				if frame < 0 || int(frame) >= len(instanceMethodIds) {
+					return errors.Errorf("method id %d out of range", frame)
 				}
 
 				// transpose into arrays
-				methodIds = append(methodIds, methodId)
+				methodIds = append(methodIds, instanceMethodIds[frame])
 			}
 
 			// calculate stack id as hash from method ids
@@ -99,79 +157,315 @@ func (ingester *Ingester) Ingest(ctx context.Context, profile Profile) error {
 			return errors.WithMessage(err, "store stacks")
 		}
 
-		stackTimes := map[SampleKey]map[int64]time.Duration{}
-		for idx, sample := range profile.Samples {
-			stack := stacks[idx]
+		// dropped profiles are reported with the next profile of any type
+		if err := ingester.storeSampleStats(ctx, instanceId, profile); err != nil {
+			return errors.WithMessage(err, "store sample statistics")
+		}
+
+		switch profile.Type {
+		case "", "cpu":
+			if profile.Metrics != nil {
+				if err := ingester.storeRuntimeMetrics(ctx, instanceId, profile); err != nil {
+					return errors.WithMessage(err, "store runtime metrics")
+				}
+			}
 
-			// add sample to time timeSlot
-			const binSize = 60 * time.Second
-			timeSlot := int32(timeSlotOf(time.Unix(0, sample.TimestampNs), binSize).Unix())
-			key := SampleKey{timeSlot, instanceId}
+			if err := ingester.storeSpans(ctx, instanceId, profile, stacks); err != nil {
+				return errors.WithMessage(err, "store spans")
+			}
 
-			// update timings in aggregation
-			items := stackTimes[key]
-			if items == nil {
-				items = map[int64]time.Duration{}
-				stackTimes[key] = items
+			return ingester.storeSamples(ctx, instanceId, profile, stacks)
+
+		case "goroutine":
+			if err := ingester.storeGoroutineCount(ctx, instanceId, profile); err != nil {
+				return errors.WithMessage(err, "store goroutine count")
 			}
 
-			items[stack.Id] += time.Duration(sample.DurationNs)
+			return ingester.storeValueSamples(ctx, instanceId, profile, stacks)
+
+		default:
+			return ingester.storeValueSamples(ctx, instanceId, profile, stacks)
 		}
+	})
 
-		for key, durations := range stackTimes {
-			var previousItems []dbSampleItem
+	if err == nil && instanceMethodIds != nil {
+		ingester.cacheInstanceMethods(instanceId, instanceMethodIds)
+	}
 
-		tryAgain:
-			// load the previous sample if it exists
-			var row struct {
-				Version int32           `db:"version"`
-				Items   pq.GenericArray `db:"items"`
-			}
+	return result, err
+}
+
+// storeSamples aggregates the durations of the cpu samples by timeslot
+// and stores them in the ap_sample table.
+func (ingester *Ingester) storeSamples(ctx context.Context, instanceId int32, profile Profile, stacks []Stack) error {
+	type SampleKey struct {
+		Timeslot   int32
+		InstanceId int32
+
+		// the labels of the samples in json format.
+		Labels string
+
+		// the kind of the samples, e.g. cpu or offcpu
+		Kind string
+	}
+
+	tx := mustTx(TransactionFromContext(ctx))
+
+	stackTimes := map[SampleKey]map[int64]time.Duration{}
+	for idx, sample := range profile.Samples {
+		stack := stacks[idx]
+
+		// add sample to time timeSlot
+		timeSlot := timeSlotOfSample(sample)
+		labels := labelsOrEmpty(withoutSpanIds(sample.Labels))
+		key := SampleKey{timeSlot, instanceId, string(pqJSON(labels)), kindOrDefault(sample.Kind)}
+
+		// update timings in aggregation
+		items := stackTimes[key]
+		if items == nil {
+			items = map[int64]time.Duration{}
+			stackTimes[key] = items
+		}
+
+		items[stack.Id] += time.Duration(sample.DurationNs)
+	}
+
+	for key, durations := range stackTimes {
+		var previousItems []dbSampleItem
+
+	tryAgain:
+		// load the previous sample if it exists
+		var row struct {
+			Version int32           `db:"version"`
+			Items   pq.GenericArray `db:"items"`
+		}
+
+		row.Items = pq.GenericArray{A: &previousItems}
 
-			row.Items = pq.GenericArray{A: &previousItems}
+		err := tx.GetContext(ctx, &row,
+			`SELECT version, items FROM ap_sample WHERE timeslot=$1 AND instance_id=$2 AND labels=$3 AND kind=$4`,
+			key.Timeslot, key.InstanceId, types.JSONText(key.Labels), key.Kind)
+
+		if err != nil && err != sql.ErrNoRows {
+			return errors.WithMessage(err, "lookup previous items")
+		}
+
+		// add old values to the new durations
+		for _, item := range previousItems {
+			durations[item.StackId] += item.Duration
+		}
+
+		// convert durations back to slice of db types
+		var items []dbSampleItem
+		for stackId, duration := range durations {
+			items = append(items, dbSampleItem{stackId, duration})
+		}
 
-			err := tx.GetContext(ctx, &row,
-				`SELECT version, items FROM ap_sample WHERE timeslot=$1 AND instance_id=$2`,
-				key.Timeslot, key.InstanceId)
+		// sort by stack id
+		sort.Slice(items, func(i, j int) bool { return items[i].StackId < items[j].StackId })
 
-			if err != nil && err != sql.ErrNoRows {
-				return errors.WithMessage(err, "lookup previous items")
+		var updated int
+		err = tx.GetContext(ctx, &updated,
+			`INSERT INTO ap_sample (timeslot, instance_id, labels, kind, version, items) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (timeslot, instance_id, labels, kind) DO UPDATE
+			SET version=$5+1, items=EXCLUDED.items
+			WHERE ap_sample.version = $5 RETURNING version`,
+			key.Timeslot, key.InstanceId, types.JSONText(key.Labels), key.Kind, row.Version, pq.Array(items))
+
+		if err == sql.ErrNoRows {
+			logrus.Warn("optimistic locking error")
+			goto tryAgain
+		}
+
+		if err != nil {
+			return errors.WithMessage(err, "update failed")
+		}
+	}
+
+	return nil
+}
+
+// storeValueSamples aggregates the values of the samples of a non cpu profile,
+// like a heap profile, by timeslot and stores them in the ap_value_sample table.
+func (ingester *Ingester) storeValueSamples(ctx context.Context, instanceId int32, profile Profile, stacks []Stack) error {
+	type SampleKey struct {
+		Timeslot   int32
+		InstanceId int32
+
+		// the type of the value, e.g. alloc_bytes
+		ValueType string
+	}
+
+	tx := mustTx(TransactionFromContext(ctx))
+
+	stackValues := map[SampleKey]map[int64]int64{}
+	for idx, sample := range profile.Samples {
+		stack := stacks[idx]
+
+		if len(sample.Values) != len(profile.ValueTypes) {
+			return errors.Errorf("sample has %d values, expected %d", len(sample.Values), len(profile.ValueTypes))
+		}
+
+		timeSlot := timeSlotOfSample(sample)
+
+		for valueIdx, valueType := range profile.ValueTypes {
+			key := SampleKey{timeSlot, instanceId, valueType}
+
+			items := stackValues[key]
+			if items == nil {
+				items = map[int64]int64{}
+				stackValues[key] = items
 			}
 
-			// add old values to the new durations
+			items[stack.Id] += sample.Values[valueIdx]
+		}
+	}
+
+	for key, values := range stackValues {
+		var previousItems []dbValueItem
+
+	tryAgain:
+		// load the previous sample if it exists
+		var row struct {
+			Version int32           `db:"version"`
+			Items   pq.GenericArray `db:"items"`
+		}
+
+		row.Items = pq.GenericArray{A: &previousItems}
+
+		err := tx.GetContext(ctx, &row,
+			`SELECT version, items FROM ap_value_sample
+			WHERE timeslot=$1 AND instance_id=$2 AND profile_type=$3 AND value_type=$4`,
+			key.Timeslot, key.InstanceId, profile.Type, key.ValueType)
+
+		if err != nil && err != sql.ErrNoRows {
+			return errors.WithMessage(err, "lookup previous items")
+		}
+
+		// add old values to the new values. A goroutine profile is a snapshot
+		// of all goroutines and replaces an older snapshot of the timeslot.
+		if profile.Type != "goroutine" {
 			for _, item := range previousItems {
-				durations[item.StackId] += item.Duration
+				values[item.StackId] += item.Amount
 			}
+		}
 
-			// convert durations back to slice of db types
-			var items []dbSampleItem
-			for stackId, duration := range durations {
-				items = append(items, dbSampleItem{stackId, duration})
-			}
+		// convert values back to slice of db types
+		var items []dbValueItem
+		for stackId, value := range values {
+			items = append(items, dbValueItem{stackId, value})
+		}
 
-			// sort by stack id
-			sort.Slice(items, func(i, j int) bool { return items[i].StackId < items[j].StackId })
+		// sort by stack id
+		sort.Slice(items, func(i, j int) bool { return items[i].StackId < items[j].StackId })
+
+		var updated int
+		err = tx.GetContext(ctx, &updated,
+			`INSERT INTO ap_value_sample (timeslot, instance_id, profile_type, value_type, version, items)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (timeslot, instance_id, profile_type, value_type) DO UPDATE
+			SET version=$5+1, items=EXCLUDED.items
+			WHERE ap_value_sample.version = $5 RETURNING version`,
+			key.Timeslot, key.InstanceId, profile.Type, key.ValueType, row.Version, pq.Array(items))
+
+		if err == sql.ErrNoRows {
+			logrus.Warn("optimistic locking error")
+			goto tryAgain
+		}
 
-			var updated int
-			err = tx.GetContext(ctx, &updated,
-				`INSERT INTO ap_sample (timeslot, instance_id, version, items) VALUES ($1, $2, $3, $4)
-				ON CONFLICT (timeslot, instance_id) DO UPDATE
-				SET version=$3+1, items=EXCLUDED.items
-				WHERE ap_sample.version = $3 RETURNING version`,
-				key.Timeslot, key.InstanceId, row.Version, pq.Array(items))
+		if err != nil {
+			return errors.WithMessage(err, "update failed")
+		}
+	}
 
-			if err == sql.ErrNoRows {
-				logrus.Warn("optimistic locking error")
-				goto tryAgain
-			}
+	return nil
+}
 
-			if err != nil {
-				return errors.WithMessage(err, "update failed")
-			}
+// storeGoroutineCount adds the number of goroutines of the profile to the
+// goroutine statistics of the profiles timeslot.
+func (ingester *Ingester) storeGoroutineCount(ctx context.Context, instanceId int32, profile Profile) error {
+	tx := mustTx(TransactionFromContext(ctx))
+
+	const binSize = 60 * time.Second
+	timeSlot := int32(timeSlotOf(profile.Start, binSize).Unix())
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO ap_goroutine_count (timeslot, instance_id, windows, total, max) VALUES ($1, $2, 1, $3, $3)
+		ON CONFLICT (timeslot, instance_id) DO UPDATE
+		SET windows=ap_goroutine_count.windows+1,
+			total=ap_goroutine_count.total+EXCLUDED.total,
+			max=GREATEST(ap_goroutine_count.max, EXCLUDED.max)`,
+		timeSlot, instanceId, profile.Goroutines)
+
+	return err
+}
+
+// storeSampleStats adds the number of lost samples, dropped profiles and the
+// clock drift of a profile to the statistics of the profiles timeslot. Together with
+// the sampled cpu time, this shows how much a profile can be trusted.
+func (ingester *Ingester) storeSampleStats(ctx context.Context, instanceId int32, profile Profile) error {
+	tx := mustTx(TransactionFromContext(ctx))
+
+	const binSize = 60 * time.Second
+	timeSlot := int32(timeSlotOf(profile.Start, binSize).Unix())
+
+	var cpuTime time.Duration
+	for _, sample := range profile.Samples {
+		if kindOrDefault(sample.Kind) == "cpu" {
+			cpuTime += time.Duration(sample.DurationNs)
 		}
+	}
 
-		return nil
-	})
+	drift := time.Duration(profile.ClockDriftNs)
+	if drift < 0 {
+		drift = -drift
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO ap_sample_stats (timeslot, instance_id, profiles, cpu_time_ms, lost_samples, dropped_profiles, max_clock_drift_ms)
+		VALUES ($1, $2, 1, $3, $4, $5, $6)
+		ON CONFLICT (timeslot, instance_id) DO UPDATE
+		SET profiles=ap_sample_stats.profiles+1,
+			cpu_time_ms=ap_sample_stats.cpu_time_ms+EXCLUDED.cpu_time_ms,
+			lost_samples=ap_sample_stats.lost_samples+EXCLUDED.lost_samples,
+			dropped_profiles=ap_sample_stats.dropped_profiles+EXCLUDED.dropped_profiles,
+			max_clock_drift_ms=GREATEST(ap_sample_stats.max_clock_drift_ms, EXCLUDED.max_clock_drift_ms)`,
+		timeSlot, instanceId, int64(cpuTime/time.Millisecond), profile.LostSamples, profile.DroppedProfiles,
+		int64(drift/time.Millisecond))
+
+	return err
+}
+
+// storeRuntimeMetrics adds the runtime metrics of the profile to the
+// metrics of the profiles timeslot. The gc totals are increasing,
+// so the latest values of the timeslot are kept.
+func (ingester *Ingester) storeRuntimeMetrics(ctx context.Context, instanceId int32, profile Profile) error {
+	tx := mustTx(TransactionFromContext(ctx))
+
+	const binSize = 60 * time.Second
+	timeSlot := int32(timeSlotOf(profile.Start, binSize).Unix())
+
+	metrics := profile.Metrics
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO ap_runtime_metrics (timeslot, instance_id, windows,
+			heap_inuse_total, heap_inuse_max, heap_alloc_total, heap_objects_total,
+			num_gc, pause_total_ns, goroutines_max, gomaxprocs)
+		VALUES ($1, $2, 1, $3, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (timeslot, instance_id) DO UPDATE
+		SET windows=ap_runtime_metrics.windows+1,
+			heap_inuse_total=ap_runtime_metrics.heap_inuse_total+EXCLUDED.heap_inuse_total,
+			heap_inuse_max=GREATEST(ap_runtime_metrics.heap_inuse_max, EXCLUDED.heap_inuse_max),
+			heap_alloc_total=ap_runtime_metrics.heap_alloc_total+EXCLUDED.heap_alloc_total,
+			heap_objects_total=ap_runtime_metrics.heap_objects_total+EXCLUDED.heap_objects_total,
+			num_gc=GREATEST(ap_runtime_metrics.num_gc, EXCLUDED.num_gc),
+			pause_total_ns=GREATEST(ap_runtime_metrics.pause_total_ns, EXCLUDED.pause_total_ns),
+			goroutines_max=GREATEST(ap_runtime_metrics.goroutines_max, EXCLUDED.goroutines_max),
+			gomaxprocs=EXCLUDED.gomaxprocs`,
+		timeSlot, instanceId, metrics.HeapInUse, metrics.HeapAlloc, metrics.HeapObjects,
+		metrics.NumGC, metrics.PauseTotalNs, metrics.Goroutines, metrics.GOMAXPROCS)
+
+	return err
 }
 
 type dbSampleItem struct {
@@ -214,6 +508,53 @@ func (item dbSampleItem) Value() (driver.Value, error) {
 	return fmt.Sprintf("(%d,%d)", item.StackId, item.Duration/time.Millisecond), nil
 }
 
+type dbValueItem struct {
+	StackId int64
+	Amount  int64
+}
+
+func (item *dbValueItem) Scan(src interface{}) error {
+	payload := src.([]byte)
+	if len(payload) < 2 {
+		return errors.New("invalid value item format")
+	}
+
+	if payload[0] != '(' || payload[len(payload)-1] != ')' {
+		return errors.New("invalid value item format, parenthesis not found")
+	}
+
+	sepIndex := bytes.IndexByte(payload, ',')
+	if sepIndex == -1 {
+		return errors.New("invalid value item format, sep not found")
+	}
+
+	stackId, err := strconv.ParseInt(string(payload[1:sepIndex]), 10, 64)
+	if err != nil {
+		return errors.WithMessage(err, "parsing stackId in value item")
+	}
+
+	value, err := strconv.ParseInt(string(payload[sepIndex+1:len(payload)-1]), 10, 64)
+	if err != nil {
+		return errors.WithMessage(err, "parsing value in value item")
+	}
+
+	item.StackId = stackId
+	item.Amount = value
+
+	return nil
+}
+
+func (item dbValueItem) Value() (driver.Value, error) {
+	return fmt.Sprintf("(%d,%d)", item.StackId, item.Amount), nil
+}
+
+// timeSlotOfSample returns the timeslot in seconds since the epoch
+// that the sample is aggregated into.
+func timeSlotOfSample(sample Sample) int32 {
+	const binSize = 60 * time.Second
+	return int32(timeSlotOf(time.Unix(0, sample.TimestampNs), binSize).Unix())
+}
+
 func timeSlotOf(ts time.Time, slotSize time.Duration) time.Time {
 	return time.Unix(0, ts.UnixNano()/int64(slotSize)*int64(slotSize))
 }
@@ -231,11 +572,11 @@ func hashInt32Slice(slice []int32) int64 {
 	return int64(hash.Sum64())
 }
 
-func (ingester *Ingester) methodId(ctx context.Context, name string) (int32, error) {
+func (ingester *Ingester) methodId(ctx context.Context, key MethodKey) (int32, error) {
 	tx := mustTx(TransactionFromContext(ctx))
 
 	ingester.methodCacheLock.Lock()
-	id, ok := ingester.methodCache[name]
+	id, ok := ingester.methodCache[key]
 	ingester.methodCacheLock.Unlock()
 
 	if ok {
@@ -243,18 +584,25 @@ func (ingester *Ingester) methodId(ctx context.Context, name string) (int32, err
 	}
 
 	// first try to insert
-	_, err := tx.ExecContext(ctx, `INSERT INTO ap_method (name) VALUES ($1) ON CONFLICT DO NOTHING`, name)
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO ap_method (name, file, line) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		key.Name, key.File, key.Line)
+
 	if err != nil {
 		return 0, errors.WithMessage(err, "store method name")
 	}
 
 	// and then select the inserted value
-	if err := tx.GetContext(ctx, &id, "SELECT id FROM ap_method WHERE name=$1", name); err != nil {
+	err = tx.GetContext(ctx, &id,
+		"SELECT id FROM ap_method WHERE name=$1 AND file=$2 AND line=$3",
+		key.Name, key.File, key.Line)
+
+	if err != nil {
 		return 0, errors.WithMessage(err, "get id of method")
 	}
 
 	ingester.methodCacheLock.Lock()
-	ingester.methodCache[name] = id
+	ingester.methodCache[key] = id
 	ingester.methodCacheLock.Unlock()
 
 	return id, nil
@@ -276,18 +624,18 @@ func (ingester *Ingester) fillCaches(ctx context.Context, db TxStarter) error {
 
 func (ingester *Ingester) fillMethodCache(ctx context.Context) error {
 	var methods []struct {
-		Id   int32  `db:"id"`
-		Name string `db:"name"`
+		MethodKey
+		Id int32 `db:"id"`
 	}
 
 	tx := mustTx(TransactionFromContext(ctx))
-	if err := tx.SelectContext(ctx, &methods, `SELECT id, name FROM ap_method`); err != nil {
+	if err := tx.SelectContext(ctx, &methods, `SELECT id, name, file, line FROM ap_method`); err != nil {
 		return errors.WithMessage(err, "query method ids")
 	}
 
 	locked(&ingester.methodCacheLock, func() {
 		for _, method := range methods {
-			ingester.methodCache[method.Name] = method.Id
+			ingester.methodCache[method.MethodKey] = method.Id
 		}
 	})
 
@@ -426,15 +774,78 @@ type Sample struct {
 	TimestampNs int64
 	DurationNs  int64
 	Stack       []int32
+	Labels      map[string]string
+	Kind        string
+	Values      []int64
 }
 
 type Profile struct {
+	Type        string
+	Start       time.Time
 	ServiceName string
 	InstanceId  uuid.UUID
 	Tags        map[string]string
 
-	Names   []string
-	Samples []Sample
+	ValueTypes []string
+	Names      []string
+	Samples    []Sample
+
+	// the id of the first name. The agent does not send the names
+	// of methods that are already known for the instance.
+	NamesOffset int
+
+	// file and line of each name. Those are only set
+	// if the agent includes line information.
+	Files []string
+	Lines []int32
+
+	// number of goroutines, only set for goroutine profiles
+	Goroutines int
+
+	// number of profiles the agent dropped since the
+	// previous profile was received
+	DroppedProfiles int
+
+	// number of cpu samples the runtime of the
+	// agent could not record during the window
+	LostSamples int
+
+	// how far the wall clock of the agent has moved away from the
+	// monotonic clock used for the sample timestamps.
+	ClockDriftNs int64
+
+	// runtime statistics at the end of the window,
+	// only set for cpu profiles.
+	Metrics *RuntimeMetrics
+
+	// the slowest spans that ended during the window,
+	// only set for cpu profiles.
+	Spans []SpanRecord
+}
+
+// RuntimeMetrics is a snapshot of the runtime statistics of an instance.
+// The number of gc cycles and the pause time are totals since
+// the instance was started.
+type RuntimeMetrics struct {
+	HeapInUse    int64
+	HeapAlloc    int64
+	HeapObjects  int64
+	NumGC        int64
+	PauseTotalNs int64
+	Goroutines   int32
+	GOMAXPROCS   int32
+}
+
+// methodKey returns the key of the method with the given local id.
+func (profile *Profile) methodKey(localId int32) MethodKey {
+	key := MethodKey{Name: profile.Names[localId]}
+
+	if int(localId) < len(profile.Files) && int(localId) < len(profile.Lines) {
+		key.File = profile.Files[localId]
+		key.Line = profile.Lines[localId]
+	}
+
+	return key
 }
 
 func pqJSON(v interface{}) types.JSONText {
@@ -446,6 +857,56 @@ func pqJSON(v interface{}) types.JSONText {
 	return types.JSONText(b)
 }
 
+func labelsOrEmpty(labels map[string]string) map[string]string {
+	if labels == nil {
+		return map[string]string{}
+	}
+
+	return labels
+}
+
+// the tag of profiles that the agent recorded during a burst
+// with a higher sample frequency.
+const burstTag = "burst"
+
+// withoutKey returns a copy of the map without the given key,
+// and the value of the removed key.
+func withoutKey(values map[string]string, key string) (map[string]string, string) {
+	removed, ok := values[key]
+	if !ok {
+		return values, ""
+	}
+
+	result := make(map[string]string, len(values))
+	for k, value := range values {
+		if k != key {
+			result[k] = value
+		}
+	}
+
+	return result, removed
+}
+
+// withLabel returns a copy of the labels with the given label added.
+func withLabel(labels map[string]string, key, value string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for key, value := range labels {
+		result[key] = value
+	}
+
+	result[key] = value
+
+	return result
+}
+
+func kindOrDefault(kind string) string {
+	if kind == "" {
+		return "cpu"
+	}
+
+	return kind
+}
+
 func locked(m *sync.Mutex, fn func()) {
 	m.Lock()
 	defer m.Unlock()
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"github.com/NYTimes/gziphandler"
 	"github.com/flachnetz/startup"
@@ -9,7 +10,12 @@ import (
 	"github.com/flachnetz/startup/startup_http"
 	"github.com/flachnetz/startup/startup_postgres"
 	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 func main() {
@@ -34,18 +40,128 @@ func main() {
 		Name: "ingest",
 		Routing: func(router *httprouter.Router) http.Handler {
 			router.POST("/v1/profile", HandlerIngest(ingester))
-			return gziphandler.GzipHandler(router)
+			router.GET("/v1/settings/:service", HandlerSettings(ingester))
+			router.PUT("/v1/settings/:service", HandlerUpdateSettings(ingester))
+			return gziphandler.GzipHandler(DecompressRequest(router))
 		},
 	})
 }
 
+// the maximum size of a request body, after decompression.
+const maxRequestBodySize = 64 * 1024 * 1024
+
+// DecompressRequest transparently decompresses gzip or zstd
+// compressed request bodies, based on the Content-Encoding header.
+// gziphandler only takes care of compressing the responses. The
+// size of all request bodies is limited to maxRequestBodySize.
+func DecompressRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.ReadCloser
+
+		switch encoding := r.Header.Get("Content-Encoding"); encoding {
+		case "", "identity":
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+			handler.ServeHTTP(w, r)
+			return
+
+		case "gzip":
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid gzip request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			body = reader
+
+		case "zstd":
+			reader, err := zstd.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid zstd request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			body = zstdReadCloser{reader}
+
+		default:
+			http.Error(w, "unsupported content encoding: "+encoding, http.StatusUnsupportedMediaType)
+			return
+		}
+
+		defer closeIgnoreErr(body)
+
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		r.Body = http.MaxBytesReader(w, body, maxRequestBodySize)
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// zstdReadCloser adapts the zstd decoder, which does
+// not return an error on Close, to an io.ReadCloser.
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
 func HandlerIngest(ingester *Ingester) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeBinaryPrefix) {
+			var opts struct{}
+
+			startup_http.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+				payload, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return nil, errors.WithMessage(err, "read request body")
+				}
+
+				body, err := decodeBinaryProfile(payload)
+				if err != nil {
+					return nil, err
+				}
+
+				return ingester.Ingest(r.Context(), body)
+			})
+
+			return
+		}
+
 		var body Profile
 
 		startup_http.ExtractAndCallWithBody(nil, &body, w, r, params, func() (interface{}, error) {
-			err := ingester.Ingest(r.Context(), body)
-			return nil, err
+			return ingester.Ingest(r.Context(), body)
+		})
+	}
+}
+
+func HandlerSettings(ingester *Ingester) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		startup_http.ExtractAndCall(&opts, w, r, params, func() (interface{}, error) {
+			return ingester.Settings(r.Context(), opts.Service)
+		})
+	}
+}
+
+func HandlerUpdateSettings(ingester *Ingester) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		// a service is enabled unless the request disables it explicitly
+		body := AgentSettings{Enabled: true}
+
+		startup_http.ExtractAndCallWithBody(&opts, &body, w, r, params, func() (interface{}, error) {
+			return nil, ingester.UpdateSettings(r.Context(), opts.Service, body)
 		})
 	}
 }
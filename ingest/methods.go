@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	. "github.com/flachnetz/startup/startup_postgres"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// instances that did not send a profile for this long are
+// removed from the cache of their method ids.
+const instanceMethodCacheTTL = time.Hour
+
+type instanceMethods struct {
+	methodIds []int32
+	lastSeen  time.Time
+}
+
+// IngestResult is the response to an ingested profile.
+type IngestResult struct {
+	// the number of method names of the instance that are known. The agent
+	// only needs to send the names of methods with a larger id. If this is
+	// smaller than the names offset of the profile, the profile was not
+	// ingested and must be send again with the missing names.
+	KnownNames int `json:"knownNames"`
+}
+
+// instanceMethodIds returns the global method ids for the local method ids
+// of the instance. The names of the profile start at the names offset, all
+// methods before must be known from previous profiles of the instance. If
+// they are not, ok is false and the known methods are returned. The method
+// ids are only added to the cache by cacheInstanceMethods, once the
+// transaction was committed.
+func (ingester *Ingester) instanceMethodIds(ctx context.Context, instanceId int32, profile Profile) (methodIds []int32, ok bool, err error) {
+	methodIds, err = ingester.knownInstanceMethods(ctx, instanceId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if profile.NamesOffset > len(methodIds) {
+		return methodIds, false, nil
+	}
+
+	// the names that are new for this instance
+	newNames := profile.NamesOffset + len(profile.Names) - len(methodIds)
+	if newNames <= 0 {
+		return methodIds, true, nil
+	}
+
+	tx := mustTx(TransactionFromContext(ctx))
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO ap_instance_method (instance_id, local_id, method_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`)
+
+	if err != nil {
+		return nil, false, errors.WithMessage(err, "prepare insert instance method stmt")
+	}
+
+	defer closeIgnoreErr(stmt)
+
+	// copy, as the slice might be shared with the cache
+	methodIds = append([]int32(nil), methodIds...)
+
+	for localId := len(methodIds); localId < profile.NamesOffset+len(profile.Names); localId++ {
+		methodId, err := ingester.methodId(ctx, profile.methodKey(int32(localId-profile.NamesOffset)))
+		if err != nil {
+			return nil, false, errors.WithMessage(err, "lookup method")
+		}
+
+		if _, err := stmt.ExecContext(ctx, instanceId, localId, methodId); err != nil {
+			return nil, false, errors.WithMessage(err, "store instance method")
+		}
+
+		methodIds = append(methodIds, methodId)
+	}
+
+	return methodIds, true, nil
+}
+
+// cacheInstanceMethods caches the method ids of the instance. It must only be
+// called after the transaction that stored the method ids was committed.
+// Instances not seen for instanceMethodCacheTTL are evicted from the cache.
+func (ingester *Ingester) cacheInstanceMethods(instanceId int32, methodIds []int32) {
+	now := time.Now()
+
+	locked(&ingester.instanceMethodCacheLock, func() {
+		cached, ok := ingester.instanceMethodCache[instanceId]
+
+		// a concurrent request might have added more methods in the meantime
+		if !ok || len(methodIds) > len(cached.methodIds) {
+			cached.methodIds = methodIds
+		}
+
+		cached.lastSeen = now
+		ingester.instanceMethodCache[instanceId] = cached
+
+		if now.Sub(ingester.instanceMethodCacheEvicted) < instanceMethodCacheTTL/10 {
+			return
+		}
+
+		for id, entry := range ingester.instanceMethodCache {
+			if now.Sub(entry.lastSeen) > instanceMethodCacheTTL {
+				delete(ingester.instanceMethodCache, id)
+			}
+		}
+
+		ingester.instanceMethodCacheEvicted = now
+	})
+}
+
+// knownInstanceMethods returns the global method ids of the methods known
+// for the instance, indexed by the local method id of the instance.
+func (ingester *Ingester) knownInstanceMethods(ctx context.Context, instanceId int32) ([]int32, error) {
+	ingester.instanceMethodCacheLock.Lock()
+	cached, ok := ingester.instanceMethodCache[instanceId]
+	ingester.instanceMethodCacheLock.Unlock()
+
+	if ok {
+		return cached.methodIds, nil
+	}
+
+	var methodIds []int32
+
+	var methods []struct {
+		LocalId  int   `db:"local_id"`
+		MethodId int32 `db:"method_id"`
+	}
+
+	tx := mustTx(TransactionFromContext(ctx))
+
+	err := tx.SelectContext(ctx, &methods, `
+		SELECT local_id, method_id FROM ap_instance_method
+		WHERE instance_id=$1
+		ORDER BY local_id`,
+		instanceId)
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "query instance methods")
+	}
+
+	// only take the methods up to the first gap. The agent
+	// sends the methods after the gap again.
+	for _, method := range methods {
+		if method.LocalId != len(methodIds) {
+			break
+		}
+
+		methodIds = append(methodIds, method.MethodId)
+	}
+
+	return methodIds, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	. "github.com/flachnetz/startup/startup_postgres"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// AgentSettings are the settings of the profiling agents of a service.
+// Fields that are nil keep the value configured in the agent.
+type AgentSettings struct {
+	Enabled           bool           `json:"enabled" db:"enabled"`
+	SampleFrequencyHz *int32         `json:"sampleFrequencyHz" db:"sample_frequency_hz"`
+	WindowDurationMs  *int32         `json:"windowDurationMs" db:"window_duration_ms"`
+	ProfileTypes      pq.StringArray `json:"profileTypes" db:"profile_types"`
+}
+
+var knownProfileTypes = map[string]bool{
+	"cpu": true, "heap": true, "mutex": true, "block": true, "goroutine": true,
+}
+
+func (settings *AgentSettings) validate() error {
+	if hz := settings.SampleFrequencyHz; hz != nil && (*hz < 1 || *hz > 1000) {
+		return fmt.Errorf("sample frequency must be between 1 and 1000, got %d", *hz)
+	}
+
+	if ms := settings.WindowDurationMs; ms != nil && *ms < 100 {
+		return fmt.Errorf("window duration must be at least 100ms, got %dms", *ms)
+	}
+
+	for _, profileType := range settings.ProfileTypes {
+		if !knownProfileTypes[profileType] {
+			return fmt.Errorf("unknown profile type '%s'", profileType)
+		}
+	}
+
+	return nil
+}
+
+// Settings returns the agent settings of the given service. If no settings
+// are stored for the service, the agents should use their own configuration.
+func (ingester *Ingester) Settings(ctx context.Context, serviceName string) (AgentSettings, error) {
+	var settings AgentSettings
+
+	err := ingester.db.GetContext(ctx, &settings, `
+		SELECT enabled, sample_frequency_hz, window_duration_ms, profile_types
+		FROM ap_agent_settings
+		WHERE service_id = (SELECT id FROM ap_service WHERE name=$1)`,
+		serviceName)
+
+	if err == sql.ErrNoRows {
+		return AgentSettings{Enabled: true}, nil
+	}
+
+	if err != nil {
+		return AgentSettings{}, errors.WithMessage(err, "query agent settings")
+	}
+
+	return settings, nil
+}
+
+// UpdateSettings stores the agent settings of the given service.
+func (ingester *Ingester) UpdateSettings(ctx context.Context, serviceName string, settings AgentSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+
+	return WithTransactionContext(ctx, ingester.db, func(ctx context.Context, tx *sqlx.Tx) error {
+		serviceId, err := ingester.serviceId(ctx, serviceName)
+		if err != nil {
+			return errors.WithMessage(err, "ensure service exists")
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO ap_agent_settings (service_id, enabled, sample_frequency_hz, window_duration_ms, profile_types)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (service_id) DO UPDATE SET
+				enabled = excluded.enabled,
+				sample_frequency_hz = excluded.sample_frequency_hz,
+				window_duration_ms = excluded.window_duration_ms,
+				profile_types = excluded.profile_types`,
+			serviceId, settings.Enabled, settings.SampleFrequencyHz, settings.WindowDurationMs, settings.ProfileTypes)
+
+		if err != nil {
+			return errors.WithMessage(err, "store agent settings")
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	. "github.com/flachnetz/startup/startup_postgres"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// labels of the samples recorded during a span, see pprof.Span in the agent.
+const (
+	labelSpan    = "span"
+	labelSpanId  = "span_id"
+	labelTraceId = "trace_id"
+)
+
+// SpanRecord describes a span that ended on the agent.
+type SpanRecord struct {
+	Name       string
+	TraceId    string
+	SpanId     string
+	StartNs    int64
+	DurationNs int64
+}
+
+// storeSpans stores the finished spans of the profile and the samples that
+// were recorded during a span. The samples are aggregated by span and stack,
+// so the samples of a trace can be found by its trace id.
+func (ingester *Ingester) storeSpans(ctx context.Context, instanceId int32, profile Profile, stacks []Stack) error {
+	tx := mustTx(TransactionFromContext(ctx))
+
+	for _, span := range profile.Spans {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO ap_span (trace_id, span_id, instance_id, name, start_time, duration_ns)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT DO NOTHING`,
+			span.TraceId, span.SpanId, instanceId, span.Name, time.Unix(0, span.StartNs), span.DurationNs)
+
+		if err != nil {
+			return errors.WithMessage(err, "store span")
+		}
+	}
+
+	type SpanSampleKey struct {
+		TraceId string
+		SpanId  string
+		Span    string
+		StackId int64
+	}
+
+	durations := map[SpanSampleKey]int64{}
+	timeSlots := map[SpanSampleKey]int32{}
+
+	for idx, sample := range profile.Samples {
+		traceId := sample.Labels[labelTraceId]
+		if traceId == "" {
+			continue
+		}
+
+		key := SpanSampleKey{traceId, sample.Labels[labelSpanId], sample.Labels[labelSpan], stacks[idx].Id}
+		durations[key] += sample.DurationNs
+
+		if _, ok := timeSlots[key]; !ok {
+			timeSlots[key] = timeSlotOfSample(sample)
+		}
+	}
+
+	for key, duration := range durations {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO ap_span_sample (trace_id, span_id, instance_id, span, timeslot, stack_id, duration_ns)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (trace_id, span_id, stack_id) DO UPDATE
+			SET duration_ns=ap_span_sample.duration_ns+EXCLUDED.duration_ns`,
+			key.TraceId, key.SpanId, instanceId, key.Span, timeSlots[key], key.StackId, duration)
+
+		if err != nil {
+			return errors.WithMessage(err, "store span sample")
+		}
+	}
+
+	return nil
+}
+
+// withoutSpanIds removes the span and trace id from the labels of a sample.
+// Those are unique per request and would create a new sample row for each
+// request. The name of the span is kept.
+func withoutSpanIds(labels map[string]string) map[string]string {
+	labels, _ = withoutKey(labels, labelSpanId)
+	labels, _ = withoutKey(labels, labelTraceId)
+	return labels
+}
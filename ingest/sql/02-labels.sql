@@ -0,0 +1,14 @@
+-- +migrate Up
+
+-- the pprof labels of the goroutine that was sampled. Samples
+-- are aggregated per distinct set of labels.
+ALTER TABLE ap_sample
+  ADD COLUMN labels JSONB NOT NULL DEFAULT '{}'::JSONB;
+
+ALTER TABLE ap_sample
+  DROP CONSTRAINT ap_sample_timeslot_instance_id_key;
+
+ALTER TABLE ap_sample
+  ADD CONSTRAINT ap_sample_timeslot_instance_id_labels_key UNIQUE (timeslot, instance_id, labels);
+
+CREATE INDEX ap_sample_labels_idx ON ap_sample USING GIN (labels);
@@ -0,0 +1,12 @@
+-- +migrate Up
+
+-- how the samples were captured, e.g. 'cpu' for on-cpu samples
+-- or 'offcpu' for stacks of parked goroutines.
+ALTER TABLE ap_sample
+  ADD COLUMN kind TEXT NOT NULL DEFAULT 'cpu';
+
+ALTER TABLE ap_sample
+  DROP CONSTRAINT ap_sample_timeslot_instance_id_labels_key;
+
+ALTER TABLE ap_sample
+  ADD CONSTRAINT ap_sample_timeslot_instance_id_labels_kind_key UNIQUE (timeslot, instance_id, labels, kind);
@@ -0,0 +1,35 @@
+-- +migrate Up
+
+CREATE TYPE ap_value_item AS (
+  -- the stack id that was observed
+  stack_id INT8,
+
+  -- the value of the stack, e.g. the number of allocated bytes
+  value    INT8
+);
+
+-- samples of profiles that do not measure cpu time, like heap profiles.
+-- Each profile type has multiple value types, e.g. alloc_bytes and inuse_bytes,
+-- that are stored in separate rows.
+CREATE TABLE ap_value_sample (
+  -- Timeslot of this sample in seconds since the epoch.
+  timeslot     INT4 NOT NULL,
+
+  -- the instance that send this sample
+  instance_id  INT4 NOT NULL REFERENCES ap_instance (id),
+
+  -- the type of profile, e.g. heap
+  profile_type TEXT NOT NULL,
+
+  -- the type of the values in this sample, e.g. alloc_bytes
+  value_type   TEXT NOT NULL,
+
+  -- version used for optimistic locking
+  version      INT4 NOT NULL,
+
+  -- the items of this sample. They should be normalized, so (item).stack_id
+  -- should be unique.
+  items        ap_value_item[],
+
+  UNIQUE (timeslot, instance_id, profile_type, value_type)
+);
@@ -0,0 +1,21 @@
+-- +migrate Up
+
+-- the number of goroutines of each instance, aggregated per timeslot.
+CREATE TABLE ap_goroutine_count (
+  -- Timeslot of this sample in seconds since the epoch.
+  timeslot    INT4 NOT NULL,
+
+  -- the instance that send the goroutine count
+  instance_id INT4 NOT NULL REFERENCES ap_instance (id),
+
+  -- number of windows that were aggregated into this row
+  windows     INT4 NOT NULL,
+
+  -- sum of the goroutine counts of all windows
+  total       INT8 NOT NULL,
+
+  -- the maximum goroutine count of all windows
+  max         INT4 NOT NULL,
+
+  UNIQUE (timeslot, instance_id)
+);
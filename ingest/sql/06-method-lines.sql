@@ -0,0 +1,13 @@
+-- +migrate Up
+
+-- source file and line of a method. Those are empty if
+-- the agent does not send line information.
+ALTER TABLE ap_method
+  ADD COLUMN file TEXT NOT NULL DEFAULT '',
+  ADD COLUMN line INT4 NOT NULL DEFAULT 0;
+
+ALTER TABLE ap_method
+  DROP CONSTRAINT ap_method_name_key;
+
+ALTER TABLE ap_method
+  ADD CONSTRAINT ap_method_name_file_line_key UNIQUE (name, file, line);
@@ -0,0 +1,22 @@
+-- +migrate Up
+
+-- settings of the profiling agents of a service. The agents poll
+-- their settings periodically and reconfigure themselves.
+CREATE TABLE ap_agent_settings (
+  service_id          INT4    NOT NULL PRIMARY KEY REFERENCES ap_service (id),
+
+  -- disables all profiling if false
+  enabled             BOOLEAN NOT NULL DEFAULT TRUE,
+
+  -- sample frequency of the cpu profiler. NULL keeps
+  -- the frequency configured in the agent.
+  sample_frequency_hz INT4,
+
+  -- length of a profile window in milliseconds. NULL keeps
+  -- the window duration configured in the agent.
+  window_duration_ms  INT4,
+
+  -- the profile types to collect, e.g. cpu or heap. NULL
+  -- enables all profile types configured in the agent.
+  profile_types       TEXT[]
+);
@@ -0,0 +1,33 @@
+-- +migrate Up
+
+-- runtime statistics of each instance, aggregated per timeslot.
+CREATE TABLE ap_runtime_metrics (
+  -- Timeslot of the metrics in seconds since the epoch.
+  timeslot           INT4 NOT NULL,
+
+  -- the instance that send the metrics
+  instance_id        INT4 NOT NULL REFERENCES ap_instance (id),
+
+  -- number of windows that were aggregated into this row
+  windows            INT4 NOT NULL,
+
+  -- sum of the heap statistics of all windows
+  heap_inuse_total   INT8 NOT NULL,
+  heap_alloc_total   INT8 NOT NULL,
+  heap_objects_total INT8 NOT NULL,
+
+  -- the maximum of the in-use heap of all windows
+  heap_inuse_max     INT8 NOT NULL,
+
+  -- number of gc cycles and total gc pause time since the
+  -- instance was started, at the end of the timeslot.
+  num_gc             INT8 NOT NULL,
+  pause_total_ns     INT8 NOT NULL,
+
+  -- the maximum goroutine count of all windows
+  goroutines_max     INT4 NOT NULL,
+
+  gomaxprocs         INT4 NOT NULL,
+
+  UNIQUE (timeslot, instance_id)
+);
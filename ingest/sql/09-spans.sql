@@ -0,0 +1,43 @@
+-- +migrate Up
+
+-- spans that ended on the agents. The agents only send the
+-- slowest spans of each window.
+CREATE TABLE ap_span (
+  trace_id    TEXT        NOT NULL,
+  span_id     TEXT        NOT NULL,
+
+  -- the instance that recorded the span
+  instance_id INT4        NOT NULL REFERENCES ap_instance (id),
+
+  -- the name of the span, e.g. an endpoint
+  name        TEXT        NOT NULL,
+
+  start_time  TIMESTAMPTZ NOT NULL,
+  duration_ns INT8        NOT NULL,
+
+  PRIMARY KEY (trace_id, span_id)
+);
+
+CREATE INDEX ap_span_name_idx ON ap_span (name, duration_ns);
+
+-- the cpu samples recorded during a span, aggregated by stack.
+CREATE TABLE ap_span_sample (
+  trace_id    TEXT NOT NULL,
+  span_id     TEXT NOT NULL,
+  instance_id INT4 NOT NULL REFERENCES ap_instance (id),
+
+  -- the name of the span
+  span        TEXT NOT NULL,
+
+  -- Timeslot of the first sample in seconds since the epoch.
+  timeslot    INT4 NOT NULL,
+
+  stack_id    INT8 NOT NULL,
+
+  -- sum of the durations of all samples of the stack
+  duration_ns INT8 NOT NULL,
+
+  UNIQUE (trace_id, span_id, stack_id)
+);
+
+CREATE INDEX ap_span_sample_span_idx ON ap_span_sample (span, timeslot);
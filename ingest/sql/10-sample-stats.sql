@@ -0,0 +1,25 @@
+-- +migrate Up
+
+-- statistics about the completeness of the profiles
+-- of each instance, aggregated per timeslot.
+CREATE TABLE ap_sample_stats (
+  -- Timeslot of the statistics in seconds since the epoch.
+  timeslot         INT4 NOT NULL,
+
+  -- the instance that send the profiles
+  instance_id      INT4 NOT NULL REFERENCES ap_instance (id),
+
+  -- number of profiles that were aggregated into this row
+  profiles         INT4 NOT NULL,
+
+  -- the sum of the durations of all cpu samples in millis
+  cpu_time_ms      INT8 NOT NULL,
+
+  -- number of samples the runtime of the agent could not record
+  lost_samples     INT8 NOT NULL,
+
+  -- number of profiles the agent dropped before sending them
+  dropped_profiles INT8 NOT NULL,
+
+  UNIQUE (timeslot, instance_id)
+);
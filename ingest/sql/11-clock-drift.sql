@@ -0,0 +1,7 @@
+-- +migrate Up
+
+-- the largest absolute difference between the wall clock and the
+-- monotonic clock of the instance, that the sample timestamps are
+-- based on, in millis.
+ALTER TABLE ap_sample_stats
+  ADD COLUMN max_clock_drift_ms INT8 NOT NULL DEFAULT 0;
@@ -0,0 +1,14 @@
+-- +migrate Up
+
+-- maps the method ids of an instance to the ids in ap_method. The agents
+-- keep the ids of their methods stable and only send the names of methods
+-- that are not yet known for the instance.
+CREATE TABLE ap_instance_method (
+  instance_id INT4 NOT NULL REFERENCES ap_instance (id),
+
+  -- the id of the method on the agent
+  local_id    INT4 NOT NULL,
+  method_id   INT4 NOT NULL REFERENCES ap_method (id),
+
+  PRIMARY KEY (instance_id, local_id)
+);
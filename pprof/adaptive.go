@@ -0,0 +1,125 @@
+package pprof
+
+import (
+	"time"
+)
+
+// adaptSampleFrequency measures the overhead of the profiler during the window
+// of the given profile and changes the sample frequency, if the overhead is
+// too high or far below the configured budget. The overhead is the time spent
+// processing the samples of the window and encoding profiles, relative to the
+// duration of the window. The time spent waiting for the network or for the
+// samples of the runtime does not use the cpu and is not part of the overhead.
+// It returns false, if the profiler was stopped while changing the sample frequency.
+func (p *profiler) adaptSampleFrequency(profile *Profile, processing time.Duration) bool {
+	elapsed := time.Since(profile.Start)
+	if elapsed <= 0 {
+		return true
+	}
+
+	cost := processing + p.collector.takeEncodingTime()
+	overhead := float64(cost) / float64(elapsed)
+
+	hz := p.nextSampleFrequency(overhead)
+	if hz == p.sampleFrequencyHz {
+		return true
+	}
+
+	p.Logger("Profiler overhead is %1.2f%% (budget %1.2f%%, profile of %d bytes), changing sample frequency from %dHz to %dHz",
+		100*overhead, 100*p.OverheadBudget, profile.estimatedSize(), p.sampleFrequencyHz, hz)
+
+	return p.changeSampleFrequency(profile, hz)
+}
+
+// nextSampleFrequency calculates the sample frequency for the next window, so
+// that the overhead stays within the budget. The frequency is reduced
+// proportionally if the budget is exceeded, and slowly increased
+// if the overhead is well below the budget.
+func (p *profiler) nextSampleFrequency(overhead float64) int {
+	current := float64(p.sampleFrequencyHz)
+
+	var target float64
+	switch {
+	case overhead > p.OverheadBudget:
+		// keep some headroom to not oscillate around the budget
+		target = 0.9 * current * p.OverheadBudget / overhead
+
+	case overhead < p.OverheadBudget/2:
+		target = 1.5 * current
+
+	default:
+		return p.sampleFrequencyHz
+	}
+
+	if target < float64(p.MinSampleFrequencyHz) {
+		target = float64(p.MinSampleFrequencyHz)
+	}
+
+	if target > float64(p.SampleFrequencyHz) {
+		target = float64(p.SampleFrequencyHz)
+	}
+
+	// ignore small changes, restarting the profiler is not free
+	if delta := target - current; delta > -0.1*current && delta < 0.1*current {
+		return p.sampleFrequencyHz
+	}
+
+	return int(target)
+}
+
+// changeSampleFrequency changes the rate of the runtime cpu profiler. The
+// runtime does not support changing the rate of a running profiler, so the
+// profiler is stopped, all remaining samples are added to the profile using
+// the previous period, and the profiler is then restarted with the new rate.
+// The period of the profile is not changed, as its samples were taken at the
+// previous rate. The next window gets the new period.
+// A frequency of zero keeps the cpu profiler stopped. It returns false,
+// if the profiler was stopped in the meantime.
+func (p *profiler) changeSampleFrequency(profile *Profile, hz int) bool {
+	if p.sampleFrequencyHz > 0 {
+		p.cpuProfiler.stop()
+
+		for {
+			eof, err := p.cpuProfiler.read(profile)
+			if err != nil {
+				p.Logger("Process profile data: %s", err)
+			}
+
+			if eof {
+				break
+			}
+		}
+
+		p.sampleFrequencyHz = 0
+	}
+
+	p.rateLock.Lock()
+	defer p.rateLock.Unlock()
+
+	if p.stopping {
+		return false
+	}
+
+	if p.paused {
+		// the cpu profiler was released, restart it on Resume
+		p.resumeFrequencyHz = hz
+
+		if p.released != nil {
+			close(p.released)
+			p.released = nil
+		}
+
+		return true
+	}
+
+	if hz > 0 {
+		if err := p.cpuProfiler.start(hz); err != nil {
+			p.Logger("Start cpu profiler: %s", err)
+			return true
+		}
+
+		p.sampleFrequencyHz = hz
+	}
+
+	return true
+}
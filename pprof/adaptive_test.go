@@ -0,0 +1,78 @@
+package pprof
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeCPUProfiler records the sample frequency it was started with.
+type fakeCPUProfiler struct {
+	hz      int
+	running bool
+}
+
+func (f *fakeCPUProfiler) start(hz int) error {
+	f.hz = hz
+	f.running = true
+	return nil
+}
+
+func (f *fakeCPUProfiler) stop() {
+	f.running = false
+}
+
+func (f *fakeCPUProfiler) read(profile *Profile) (bool, error) {
+	return !f.running, nil
+}
+
+func (f *fakeCPUProfiler) flush(profile *Profile) (bool, error) {
+	return false, nil
+}
+
+func newTestProfiler(hz int) (*profiler, *fakeCPUProfiler) {
+	cpuProfiler := &fakeCPUProfiler{hz: hz, running: true}
+
+	p := &profiler{
+		Config:            Config{Logger: func(format string, args ...interface{}) {}},
+		cpuProfiler:       cpuProfiler,
+		sampleFrequencyHz: hz,
+	}
+
+	return p, cpuProfiler
+}
+
+func TestChangeSampleFrequencyKeepsPeriod(t *testing.T) {
+	p, cpuProfiler := newTestProfiler(100)
+
+	profile := &Profile{Period: 10 * time.Millisecond}
+	if !p.changeSampleFrequency(profile, 50) {
+		t.Fatal("expected profiler to keep running")
+	}
+
+	if !cpuProfiler.running || cpuProfiler.hz != 50 || p.sampleFrequencyHz != 50 {
+		t.Errorf("expected cpu profiler to run at 50hz, got %dhz", cpuProfiler.hz)
+	}
+
+	// the samples of the window were taken at the previous rate
+	if profile.Period != 10*time.Millisecond {
+		t.Errorf("expected period of the window to stay at 10ms, got %s", profile.Period)
+	}
+}
+
+func TestChangeSampleFrequencyWhilePaused(t *testing.T) {
+	p, cpuProfiler := newTestProfiler(100)
+	p.paused = true
+
+	profile := &Profile{Period: 10 * time.Millisecond}
+	if !p.changeSampleFrequency(profile, 50) {
+		t.Fatal("expected profiler to keep running")
+	}
+
+	if cpuProfiler.running || p.sampleFrequencyHz != 0 || p.resumeFrequencyHz != 50 {
+		t.Errorf("expected cpu profiler to be restarted at 50hz on resume, got resume at %dhz", p.resumeFrequencyHz)
+	}
+
+	if profile.Period != 10*time.Millisecond {
+		t.Errorf("expected period of the window to stay at 10ms, got %s", profile.Period)
+	}
+}
@@ -0,0 +1,143 @@
+package pprof
+
+import (
+	"time"
+)
+
+// BurstConfig configures burst profiling. If the cpu usage of the process
+// stays above a threshold for a while, the sample frequency is raised
+// for a short time. This gives enough samples to explain short spikes
+// in cpu usage. Profiles recorded during a burst are tagged with burst=true.
+type BurstConfig struct {
+	// The cpu usage of the process in cores, e.g. 0.8 for 80% of one
+	// core, that triggers a burst. Zero disables burst profiling.
+	Threshold float64
+
+	// The time the cpu usage needs to stay above the
+	// threshold to trigger a burst. Defaults to 1s.
+	After time.Duration
+
+	// The sample frequency during a burst. Defaults to 250.
+	SampleFrequencyHz int
+
+	// The length of a burst. Defaults to 10s.
+	Length time.Duration
+}
+
+// burstTag is the tag added to the profiles recorded during a burst.
+const burstTag = "burst"
+
+// burstDetector measures the cpu usage of the process
+// and decides when a burst starts and ends.
+type burstDetector struct {
+	BurstConfig
+
+	// cpu time of the process at the previous measurement
+	lastMeasurement time.Time
+	lastCPUTime     time.Duration
+
+	// the start of the measurement interval since
+	// which the cpu usage is above the threshold.
+	aboveSince time.Time
+
+	// end of the current burst, zero if there is no burst.
+	until time.Time
+}
+
+// active returns true, if there is currently a burst.
+func (d *burstDetector) active() bool {
+	return !d.until.IsZero()
+}
+
+// update measures the cpu usage since the previous call. It returns
+// true, if a burst was started or the current burst has ended.
+func (d *burstDetector) update(now time.Time) (bool, error) {
+	cpuTime, err := processCPUTime()
+	if err != nil {
+		return false, err
+	}
+
+	previous := d.lastMeasurement
+	elapsed := now.Sub(previous)
+	usage := float64(cpuTime-d.lastCPUTime) / float64(elapsed)
+
+	d.lastMeasurement, d.lastCPUTime = now, cpuTime
+
+	if previous.IsZero() || elapsed <= 0 {
+		return false, nil
+	}
+
+	if d.active() {
+		if now.Before(d.until) {
+			return false, nil
+		}
+
+		// a new burst needs the cpu usage to stay above
+		// the threshold for some time again
+		d.until = time.Time{}
+		d.aboveSince = time.Time{}
+		return true, nil
+	}
+
+	if usage < d.Threshold {
+		d.aboveSince = time.Time{}
+		return false, nil
+	}
+
+	if d.aboveSince.IsZero() {
+		d.aboveSince = previous
+	}
+
+	if now.Sub(d.aboveSince) < d.After {
+		return false, nil
+	}
+
+	d.until = now.Add(d.Length)
+	return true, nil
+}
+
+// updateBurst changes the sample frequency, if a burst was started or has
+// ended. The samples recorded up to now are added to the given profile
+// using the previous sample frequency. It returns false, if the profiler
+// was stopped in the meantime.
+func (p *profiler) updateBurst(profile *Profile, changed bool) bool {
+	if p.sampleFrequencyHz == 0 {
+		// the cpu profiler is disabled by the settings
+		return true
+	}
+
+	hz := p.sampleFrequencyHz
+
+	switch {
+	case p.burst.active():
+		hz = p.Burst.SampleFrequencyHz
+
+	case changed:
+		hz = p.SampleFrequencyHz
+	}
+
+	if hz == p.sampleFrequencyHz {
+		return true
+	}
+
+	if p.burst.active() {
+		p.Logger("Cpu usage above %1.2f cores, starting burst with %dHz until %s",
+			p.Burst.Threshold, hz, p.burst.until.Format(time.RFC3339))
+	} else {
+		p.Logger("Burst has ended, restoring sample frequency of %dHz", hz)
+	}
+
+	return p.changeSampleFrequency(profile, hz)
+}
+
+// withBurstTag returns a copy of the tags with the burst tag added.
+func withBurstTag(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags)+1)
+	for key, value := range tags {
+		result[key] = value
+	}
+
+	result[burstTag] = "true"
+
+	return result
+}
@@ -0,0 +1,53 @@
+package pprof
+
+import (
+	"time"
+)
+
+// clock converts the timestamps of the cpu profiler to wall clock time.
+// The runtime records samples using its monotonic clock in nanoseconds.
+// The clock is anchored once per profiler start, using the header record
+// that the runtime writes when the cpu profiler is started. Each sample
+// timestamp is then converted relative to the anchor, so all profiles of
+// a profiler share the same time base and adjustments of the system clock
+// do not move samples between windows.
+type clock struct {
+	// wall clock time at which the cpu profiler was started. This
+	// also contains the reading of the monotonic clock of package time.
+	start time.Time
+
+	// timestamp of the runtimes header record written at start.
+	mono     uint64
+	anchored bool
+}
+
+// anchor sets the runtime timestamp that corresponds to the start time,
+// if the clock was not anchored before. Later header records, written
+// when the sample frequency is changed, are ignored.
+func (c *clock) anchor(mono uint64) {
+	if !c.anchored {
+		c.mono = mono
+		c.anchored = true
+	}
+}
+
+// unixNanos converts a runtime timestamp to nanoseconds since the epoch.
+func (c *clock) unixNanos(mono uint64) uint64 {
+	if !c.anchored {
+		// should not happen, as the header record is the first record
+		// of a profile. Assume that the sample was just recorded.
+		c.start, c.mono, c.anchored = time.Now(), mono, true
+	}
+
+	return uint64(c.start.UnixNano() + int64(mono-c.mono))
+}
+
+// drift returns how far the wall clock has moved away from the monotonic
+// clock since the profiler was started, e.g. due to adjustments of the
+// system clock. A positive drift means that the wall clock is ahead.
+func (c *clock) drift(now time.Time) time.Duration {
+	wallElapsed := now.Round(0).Sub(c.start.Round(0))
+	monoElapsed := now.Sub(c.start)
+
+	return wallElapsed - monoElapsed
+}
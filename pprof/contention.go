@@ -0,0 +1,150 @@
+package pprof
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the value types of the samples in a mutex or block profile. The delay
+// is given in nanoseconds.
+var contentionValueTypes = []string{"contentions", "delay"}
+
+type contentionValues [2]int64
+
+// contentionProfiler computes the change of a mutex or block
+// profile between two windows.
+type contentionProfiler struct {
+	typ ProfileType
+
+	// reads the records of the profile, e.g. runtime.MutexProfile
+	read func(records []runtime.BlockProfileRecord) (int, bool)
+
+	// the sampling rate of the profile. The values of each record
+	// are multiplied by this factor.
+	scale int64
+
+	// the rate of the cpu ticks in which the delays are recorded.
+	cyclesPerSecond float64
+
+	previous map[[32]uintptr]contentionValues
+}
+
+func newMutexProfiler(fraction int, cyclesPerSecond int64) valueProfiler {
+	return newContentionProfiler(ProfileTypeMutex, runtime.MutexProfile, int64(fraction), cyclesPerSecond)
+}
+
+func newBlockProfiler(cyclesPerSecond int64) valueProfiler {
+	// the block profile is sampled by duration, events blocking longer
+	// than the rate are always recorded, so the values are not scaled.
+	return newContentionProfiler(ProfileTypeBlock, runtime.BlockProfile, 1, cyclesPerSecond)
+}
+
+func newContentionProfiler(typ ProfileType, read func([]runtime.BlockProfileRecord) (int, bool), scale, cyclesPerSecond int64) *contentionProfiler {
+	c := &contentionProfiler{typ: typ, read: read, scale: scale, cyclesPerSecond: float64(cyclesPerSecond)}
+
+	// take the first snapshot as baseline, so the first window does not
+	// contain all contentions since the process was started.
+	c.previous = c.readValues()
+
+	return c
+}
+
+func (c *contentionProfiler) profileType() ProfileType {
+	return c.typ
+}
+
+func (c *contentionProfiler) valueTypes() []string {
+	return contentionValueTypes
+}
+
+// collect adds the number of contentions and the delay since the
+// previous call for each stack to the profile.
+func (c *contentionProfiler) collect(profile *Profile) {
+	current := c.readValues()
+
+	stampNs := uint64(time.Now().UnixNano())
+
+	for stack, values := range current {
+		previous := c.previous[stack]
+
+		delta := contentionValues{
+			values[0] - previous[0],
+			values[1] - previous[1],
+		}
+
+		if delta[0] == 0 && delta[1] == 0 {
+			continue
+		}
+
+		profile.addValues(trimStack(stack[:]), stampNs, delta[:])
+	}
+
+	c.previous = current
+}
+
+// readValues reads the current profile and sums up the values of all
+// records by their stack. The delay is converted from cpu ticks to nanoseconds.
+func (c *contentionProfiler) readValues() map[[32]uintptr]contentionValues {
+	records := readBlockProfile(c.read)
+
+	values := make(map[[32]uintptr]contentionValues, len(records))
+	for _, record := range records {
+		v := values[record.Stack0]
+		v[0] += record.Count * c.scale
+		v[1] += int64(float64(record.Cycles)/c.cyclesPerSecond*1e9) * c.scale
+		values[record.Stack0] = v
+	}
+
+	return values
+}
+
+// contentionCyclesPerSecond returns the rate of the cpu ticks in which the
+// runtime records the delays of contentions. If the function of the runtime
+// could not be resolved, e.g. in a stripped binary, the rate is taken from
+// the header of the text format written by runtime/pprof.
+func contentionCyclesPerSecond() (int64, error) {
+	if symbols.cyclesPerSecond == nil {
+		return runtime_pprof_cyclesPerSecond(), nil
+	}
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("block").WriteTo(&buf, 1); err != nil {
+		return 0, fmt.Errorf("write block profile: %s", err)
+	}
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if value := strings.TrimPrefix(line, "cycles/second="); value != line {
+			cyclesPerSecond, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || cyclesPerSecond <= 0 {
+				return 0, fmt.Errorf("invalid cycles per second in block profile: %q", value)
+			}
+
+			return cyclesPerSecond, nil
+		}
+	}
+
+	return 0, errors.New("no cycles per second in block profile")
+}
+
+func readBlockProfile(read func([]runtime.BlockProfileRecord) (int, bool)) []runtime.BlockProfileRecord {
+	// Find out how many records there are, allocate that many records,
+	// and get the data. There's a race - more records might be added
+	// between the two calls - so allocate a few extra records for safety
+	// and also try again if we're very unlucky.
+	n, _ := read(nil)
+	for {
+		records := make([]runtime.BlockProfileRecord, n+50)
+
+		var ok bool
+		n, ok = read(records)
+		if ok {
+			return records[:n]
+		}
+	}
+}
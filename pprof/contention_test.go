@@ -0,0 +1,24 @@
+package pprof
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestContentionCyclesPerSecondStripped(t *testing.T) {
+	resolveSymbols()
+
+	// fall back to runtime/pprof, as in a stripped binary
+	previous := symbols.cyclesPerSecond
+	symbols.cyclesPerSecond = errors.New("stripped")
+	defer func() { symbols.cyclesPerSecond = previous }()
+
+	cyclesPerSecond, err := contentionCyclesPerSecond()
+	if err != nil {
+		t.Fatalf("read cycles per second from block profile: %s", err)
+	}
+
+	if cyclesPerSecond <= 0 {
+		t.Errorf("expected positive cycles per second, got %d", cyclesPerSecond)
+	}
+}
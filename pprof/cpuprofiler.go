@@ -0,0 +1,250 @@
+package pprof
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// cpuProfiler controls the cpu profiler of the runtime and
+// reads the samples it recorded.
+type cpuProfiler interface {
+	// start starts the cpu profiler with the given frequency. It returns
+	// an error if the cpu profiler is already used by another tool.
+	start(hz int) error
+
+	// stop stops the cpu profiler. The samples recorded
+	// until now must still be read using read.
+	stop()
+
+	// read adds the samples recorded since the previous call to the profile.
+	// It does not block while the profiler is running. It returns eof=true
+	// once the profiler is stopped and all samples were read. read must not
+	// be called again after it returned eof.
+	read(profile *Profile) (eof bool, err error)
+
+	// flush is called at the end of each window and adds the samples that
+	// read might have held back to the profile. It returns eof=true, if
+	// the cpu profiler could not continue.
+	flush(profile *Profile) (eof bool, err error)
+}
+
+// runtimeCPUProfiler reads the samples directly from the buffer of the
+// runtime, including their timestamps. readProfile blocks until the runtime
+// has data, which might take long in an idle process. The buffer is read by
+// a goroutine in the background instead, so read never blocks the loop
+// while the cpu profiler is running.
+type runtimeCPUProfiler struct {
+	// the chunks read in the background, until one has eof set.
+	// Only accessed by the loop.
+	chunks chan cpuChunk
+
+	// set to 1 by stop. Only accessed atomically.
+	stopped int32
+}
+
+// cpuChunk is a copy of the data returned by a call to readProfile.
+type cpuChunk struct {
+	data []uint64
+	tags []unsafe.Pointer
+	eof  bool
+}
+
+// the maximum time read waits for the remaining samples after stop.
+const stoppedReadTimeout = 100 * time.Millisecond
+
+func (c *runtimeCPUProfiler) start(hz int) error {
+	// the runtime ignores the new rate if the cpu profiler is in use
+	if err := checkCPUProfilerAvailable(); err != nil {
+		return err
+	}
+
+	runtime.SetCPUProfileRate(hz)
+
+	c.chunks = make(chan cpuChunk, 64)
+	atomic.StoreInt32(&c.stopped, 0)
+
+	go readRuntimeProfile(c.chunks)
+
+	return nil
+}
+
+func (c *runtimeCPUProfiler) stop() {
+	runtime.SetCPUProfileRate(0)
+	atomic.StoreInt32(&c.stopped, 1)
+}
+
+func (c *runtimeCPUProfiler) read(profile *Profile) (bool, error) {
+	if c.chunks == nil {
+		return true, nil
+	}
+
+	var timeout <-chan time.Time
+
+	for {
+		var chunk cpuChunk
+
+		select {
+		case chunk = <-c.chunks:
+
+		default:
+			if atomic.LoadInt32(&c.stopped) == 0 {
+				return false, nil
+			}
+
+			// the runtime flushes the remaining samples after stop
+			if timeout == nil {
+				timeout = time.After(stoppedReadTimeout)
+			}
+
+			select {
+			case chunk = <-c.chunks:
+			case <-timeout:
+				return false, nil
+			}
+		}
+
+		err := profile.add(chunk.data, chunk.tags)
+
+		if chunk.eof {
+			c.chunks = nil
+			return true, err
+		}
+
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// readRuntimeProfile reads the buffer of the runtime until
+// the cpu profiler is stopped and all data was read.
+func readRuntimeProfile(chunks chan<- cpuChunk) {
+	for {
+		data, tags, eof := runtime_pprof_readProfile()
+
+		// the runtime reuses the slices on the next call
+		chunks <- cpuChunk{
+			data: append([]uint64(nil), data...),
+			tags: append([]unsafe.Pointer(nil), tags...),
+			eof:  eof,
+		}
+
+		if eof {
+			return
+		}
+	}
+}
+
+func (c *runtimeCPUProfiler) flush(profile *Profile) (bool, error) {
+	// all samples were already added by read
+	return false, nil
+}
+
+// checkCPUProfilerAvailable returns an error if another tool, e.g.
+// runtime/pprof.StartCPUProfile, uses the cpu profiler. It briefly starts
+// a profile using runtime/pprof, which fails if a profile is running, and
+// must only be called while our own cpu profiler is stopped.
+func checkCPUProfilerAvailable() error {
+	if err := pprof.StartCPUProfile(ioutil.Discard); err != nil {
+		return fmt.Errorf("cpu profiler is used by another tool: %s", err)
+	}
+
+	pprof.StopCPUProfile()
+	return nil
+}
+
+// pprofCPUProfiler uses the public api of runtime/pprof, which is used if the
+// internals of the runtime are not available. runtime/pprof only writes the
+// profile once it is stopped, so the profile is restarted at the end of each
+// window and the profile written in the meantime is parsed. The sample
+// frequency of runtime/pprof is fixed, samples are not timestamped
+// individually and a few samples are lost while restarting the profile.
+type pprofCPUProfiler struct {
+	lock    sync.Mutex
+	running bool
+	buffer  *bytes.Buffer
+}
+
+// the sample frequency used by runtime/pprof.StartCPUProfile
+const pprofSampleFrequencyHz = 100
+
+func (c *pprofCPUProfiler) start(hz int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buffer := &bytes.Buffer{}
+	if err := pprof.StartCPUProfile(buffer); err != nil {
+		return err
+	}
+
+	c.buffer = buffer
+	c.running = true
+
+	return nil
+}
+
+func (c *pprofCPUProfiler) stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.running {
+		pprof.StopCPUProfile()
+		c.running = false
+	}
+}
+
+func (c *pprofCPUProfiler) read(profile *Profile) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.running {
+		// the samples are added by flush at the end of the window
+		return false, nil
+	}
+
+	// parse what was written until the profiler was stopped
+	buffer := c.buffer
+	c.buffer = nil
+
+	if buffer == nil {
+		return true, nil
+	}
+
+	return true, profile.addProtobuf(buffer.Bytes())
+}
+
+func (c *pprofCPUProfiler) flush(profile *Profile) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.running {
+		// the remaining samples are added by read
+		return false, nil
+	}
+
+	// the profile is only written once it is stopped
+	pprof.StopCPUProfile()
+	buffer := c.buffer
+
+	c.buffer = &bytes.Buffer{}
+	if err := pprof.StartCPUProfile(c.buffer); err != nil {
+		// someone else took the cpu profiler in the meantime
+		c.buffer = nil
+		c.running = false
+
+		if parseErr := profile.addProtobuf(buffer.Bytes()); parseErr != nil {
+			return true, parseErr
+		}
+
+		return true, err
+	}
+
+	return false, profile.addProtobuf(buffer.Bytes())
+}
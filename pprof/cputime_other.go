@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package pprof
+
+import (
+	"errors"
+	"time"
+)
+
+// processCPUTime is not supported on this platform.
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("cpu time of the process is not available on this platform")
+}
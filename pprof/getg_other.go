@@ -0,0 +1,13 @@
+//go:build !386 && !amd64 && !amd64p32 && !arm && !arm64
+// +build !386,!amd64,!amd64p32,!arm,!arm64
+
+package pprof
+
+import (
+	"errors"
+)
+
+// runtime_getg is not supported on this architecture.
+func runtime_getg() (*goroutine, error) {
+	return nil, errors.New("current goroutine not available on this architecture")
+}
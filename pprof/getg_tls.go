@@ -0,0 +1,13 @@
+//go:build 386 || amd64 || amd64p32 || arm || arm64
+// +build 386 amd64 amd64p32 arm arm64
+
+package pprof
+
+import (
+	"github.com/huandu/go-tls/g"
+)
+
+// runtime_getg returns the goroutine that is currently running.
+func runtime_getg() (*goroutine, error) {
+	return (*goroutine)(g.G()), nil
+}
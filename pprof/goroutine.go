@@ -0,0 +1,70 @@
+package pprof
+
+import (
+	"runtime"
+	"time"
+)
+
+// the value types of the samples in a goroutine profile.
+var goroutineValueTypes = []string{"goroutines"}
+
+// goroutineProfiler records the number of goroutines every window, and
+// takes a snapshot of all goroutine stacks every few windows.
+type goroutineProfiler struct {
+	// take a snapshot every n windows
+	snapshotWindows int
+
+	windows int
+}
+
+func newGoroutineProfiler(snapshotWindows int) valueProfiler {
+	return &goroutineProfiler{snapshotWindows: snapshotWindows}
+}
+
+func (g *goroutineProfiler) profileType() ProfileType {
+	return ProfileTypeGoroutine
+}
+
+func (g *goroutineProfiler) valueTypes() []string {
+	return goroutineValueTypes
+}
+
+// collect records the current number of goroutines. If a snapshot is due,
+// the stacks of all goroutines are added to the profile, grouped by stack.
+func (g *goroutineProfiler) collect(profile *Profile) {
+	profile.Goroutines = runtime.NumGoroutine()
+
+	snapshot := g.windows%g.snapshotWindows == 0
+	g.windows++
+
+	if !snapshot {
+		return
+	}
+
+	stampNs := uint64(time.Now().UnixNano())
+
+	counts := map[[32]uintptr]int64{}
+	for _, record := range readGoroutineProfile() {
+		counts[record.Stack0]++
+	}
+
+	for stack, count := range counts {
+		profile.addValues(trimStack(stack[:]), stampNs, []int64{count})
+	}
+}
+
+func readGoroutineProfile() []runtime.StackRecord {
+	// Find out how many goroutines there are, allocate a few more records
+	// in case new goroutines are started between both calls and try
+	// again if we're very unlucky.
+	n, _ := runtime.GoroutineProfile(nil)
+	for {
+		records := make([]runtime.StackRecord, n+16)
+
+		var ok bool
+		n, ok = runtime.GoroutineProfile(records)
+		if ok {
+			return records[:n]
+		}
+	}
+}
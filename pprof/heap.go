@@ -0,0 +1,115 @@
+package pprof
+
+import (
+	"runtime"
+	"time"
+)
+
+// the value types of the samples in a heap profile.
+var heapValueTypes = []string{"alloc_objects", "alloc_bytes", "inuse_objects", "inuse_bytes"}
+
+type heapValues [4]int64
+
+// heapProfiler computes the change of the memory profile
+// between two windows.
+type heapProfiler struct {
+	previous map[[32]uintptr]heapValues
+}
+
+func newHeapProfiler() valueProfiler {
+	// take the allocations so far as baseline, so the first window does not
+	// contain all allocations since the process was started. The in-use
+	// values are not part of the baseline, as the changes of the in-use
+	// values must sum up to the memory in use, including the memory that
+	// was allocated before the profiler was started.
+	baseline := readHeapValues()
+	for stack, values := range baseline {
+		baseline[stack] = heapValues{values[0], values[1], 0, 0}
+	}
+
+	return &heapProfiler{previous: baseline}
+}
+
+func (h *heapProfiler) profileType() ProfileType {
+	return ProfileTypeHeap
+}
+
+func (h *heapProfiler) valueTypes() []string {
+	return heapValueTypes
+}
+
+// collect adds the difference of allocated and in-use bytes and objects
+// since the previous call for each allocation stack to the profile.
+func (h *heapProfiler) collect(profile *Profile) {
+	current := readHeapValues()
+
+	stampNs := uint64(time.Now().UnixNano())
+
+	for stack, values := range current {
+		previous := h.previous[stack]
+
+		var delta heapValues
+		var changed bool
+		for idx := range values {
+			delta[idx] = values[idx] - previous[idx]
+			changed = changed || delta[idx] != 0
+		}
+
+		if !changed {
+			continue
+		}
+
+		profile.addValues(trimStack(stack[:]), stampNs, delta[:])
+	}
+
+	h.previous = current
+}
+
+// readHeapValues reads the current memory profile and sums up the
+// values of all records by their allocation stack.
+func readHeapValues() map[[32]uintptr]heapValues {
+	records := readMemProfile()
+
+	values := make(map[[32]uintptr]heapValues, len(records))
+	for _, record := range records {
+		// there might be multiple records for the same stack,
+		// one for each allocation size.
+		v := values[record.Stack0]
+		v[0] += record.AllocObjects
+		v[1] += record.AllocBytes
+		v[2] += record.InUseObjects()
+		v[3] += record.InUseBytes()
+		values[record.Stack0] = v
+	}
+
+	return values
+}
+
+func readMemProfile() []runtime.MemProfileRecord {
+	// Find out how many records there are (MemProfile(nil, true)),
+	// allocate that many records, and get the data.
+	// There's a race - more records might be added between
+	// the two calls - so allocate a few extra records for safety
+	// and also try again if we're very unlucky.
+	n, _ := runtime.MemProfile(nil, true)
+	for {
+		records := make([]runtime.MemProfileRecord, n+50)
+
+		var ok bool
+		n, ok = runtime.MemProfile(records, true)
+		if ok {
+			return records[:n]
+		}
+	}
+}
+
+// trimStack returns the stack up to the first zero entry.
+func trimStack(stack []uintptr) []uintptr {
+	for idx, pc := range stack {
+		if pc == 0 {
+			return stack[:idx]
+		}
+	}
+
+	return stack
+}
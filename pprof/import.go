@@ -1,17 +1,40 @@
 package pprof
 
 import (
+	"context"
+	"debug/elf"
+	"errors"
 	"fmt"
-	"github.com/flachnetz/go-forceexport"
-	"github.com/huandu/go-tls/g"
-	"log"
+	"os"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
 type goroutine struct{}
 
+// the status of an unused goroutine, see runtime._Gdead.
+const goroutineStatusDead = 6
+
+// the bit the garbage collector adds to the status while
+// scanning the stack of a goroutine, see runtime._Gscan.
+const goroutineStatusScan = 0x1000
+
+// offset of atomicstatus in runtime.g of go 1.12 up to wallClockMaxGoVersion:
+// stack (2 words), stackguard0, stackguard1, _panic, _defer, m,
+// sched (7 words), syscallsp, syscallpc, stktopsp and param.
+const goroutineStatusOffset = 18 * unsafe.Sizeof(uintptr(0))
+
+// goroutineStatus returns the status of the goroutine, without the scan bit.
+func goroutineStatus(gp *goroutine) uint32 {
+	status := *(*uint32)(unsafe.Pointer(uintptr(unsafe.Pointer(gp)) + goroutineStatusOffset))
+	return status &^ goroutineStatusScan
+}
+
 var runtime_pprof_cyclesPerSecond func() int64
 
 // readProfile, provided by the runtime, returns the next chunk of
@@ -25,72 +48,242 @@ var runtime_gopark uintptr
 
 var runtime_saveg func(pc, sp uintptr, gp *goroutine, r *runtime.StackRecord)
 
+var runtime_isSystemGoroutine func(gp *goroutine, fixed bool) bool
+
 var runtime_stopTheWorld func(reason string)
 var runtime_startTheWorld func()
 
-//go:linkname runtime_allgs runtime.allgs
-var runtime_allgs []*goroutine
+// points to runtime.allgs, the list of all goroutines.
+var runtime_allgs *[]*goroutine
+
+// symbols describes the result of resolving the internals of the runtime.
+// Each error is nil if the corresponding symbols could be resolved.
+var symbols struct {
+	once sync.Once
+
+	// error resolving runtime/pprof.readProfile, required
+	// to read the cpu samples directly from the runtime.
+	readProfile error
 
-func init() {
-	// force-import the runtime/pprof module.
-	pprof.Profiles()
+	// error resolving runtime/pprof.runtime_cyclesPerSecond,
+	// required to convert the delays of contention profiles.
+	cyclesPerSecond error
 
-	// force the usage of that symbol to prevent the go compiler from seeing it as
-	// dead code. It would then remove it and the unexported methods we
-	// force import below
-	_ = fmt.Sprintf("%p", pprof.StartCPUProfile)
+	// error resolving the functions required for wall clock profiling.
+	wallClock error
+
+	// the layout of the labels the runtime stores with each cpu sample,
+	// and the error if the layout is not known.
+	labelLayout labelLayout
+	labels      error
+}
 
-	{
-		name := "runtime/pprof.runtime_cyclesPerSecond"
-		err := forceexport.GetFunc(&runtime_pprof_cyclesPerSecond, name)
+// the last version of go whose internal functions used for wall
+// clock profiling have the signatures declared above.
+const wallClockMaxGoVersion = 20
+
+// resolveSymbols looks up the internals of the runtime the first time it is
+// called. The lookup might fail for a new version of go, or if the executable
+// was stripped, in which case the profiler falls back to the public api
+// or reports an error.
+func resolveSymbols() {
+	symbols.once.Do(func() {
+		// force-import the runtime/pprof module.
+		pprof.Profiles()
+
+		// force the usage of that symbol to prevent the go compiler from seeing it as
+		// dead code. It would then remove it and the unexported methods we
+		// force import below
+		_ = fmt.Sprintf("%p", pprof.StartCPUProfile)
+
+		executable, err := readExecutableSymbols()
 		if err != nil {
-			log.Fatalln("Could not get function handle '"+name+"': ", err)
+			symbols.readProfile = err
+			symbols.cyclesPerSecond = err
+			symbols.wallClock = err
+		} else {
+			symbols.readProfile = executable.getFunc(&runtime_pprof_readProfile, "runtime/pprof.readProfile")
+			symbols.cyclesPerSecond = executable.getFunc(&runtime_pprof_cyclesPerSecond, "runtime/pprof.runtime_cyclesPerSecond")
+
+			symbols.wallClock = firstError(
+				wallClockSupported(runtime.Version()),
+				getgSupported(),
+				executable.getFunc(&runtime_saveg, "runtime.saveg"),
+				executable.getFunc(&runtime_isSystemGoroutine, "runtime.isSystemGoroutine"),
+				executable.getFunc(&runtime_stopTheWorld, "runtime.stopTheWorld"),
+				executable.getFunc(&runtime_startTheWorld, "runtime.startTheWorld"),
+				executable.find(&runtime_gopark, "runtime.gopark"),
+				executable.getVariable(unsafe.Pointer(&runtime_allgs), "runtime.allgs"))
 		}
+
+		symbols.labelLayout, symbols.labels = detectLabelLayout()
+	})
+}
+
+// wallClockSupported checks if the internal functions of the given version
+// of go match the signatures used for wall clock profiling.
+func wallClockSupported(version string) error {
+	minor, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(version, "go1."), ".", 2)[0])
+	if err != nil || !strings.HasPrefix(version, "go1.") || minor > wallClockMaxGoVersion {
+		return fmt.Errorf("wall clock profiling is not supported on %s", version)
 	}
 
-	{
-		name := "runtime/pprof.readProfile"
-		err := forceexport.GetFunc(&runtime_pprof_readProfile, name)
-		if err != nil {
-			log.Fatalln("Could not get function handle '"+name+"': ", err)
-		}
+	return nil
+}
+
+func getgSupported() error {
+	_, err := runtime_getg()
+	return err
+}
+
+// executableSymbols contains the addresses of the symbols of the
+// executable, already adjusted to the address the executable was loaded at.
+type executableSymbols map[string]uintptr
+
+// readExecutableSymbols reads the symbol table of the executable. This
+// fails for stripped binaries and executables not in the elf format.
+func readExecutableSymbols() (executableSymbols, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not find executable: %s", err)
 	}
 
-	{
-		name := "runtime.saveg"
-		err := forceexport.GetFunc(&runtime_saveg, name)
-		if err != nil {
-			log.Fatalln("Could not get function handle '"+name+"': ", err)
-		}
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read symbols of executable: %s", err)
 	}
 
-	{
-		name := "runtime.stopTheWorld"
-		err := forceexport.GetFunc(&runtime_stopTheWorld, name)
-		if err != nil {
-			log.Fatalln("Could not get function handle '"+name+"': ", err)
-		}
+	defer func() { _ = file.Close() }()
+
+	elfSymbols, err := file.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("could not read symbols of executable: %s", err)
 	}
 
-	{
-		name := "runtime.startTheWorld"
-		err := forceexport.GetFunc(&runtime_startTheWorld, name)
-		if err != nil {
-			log.Fatalln("Could not get function handle '"+name+"': ", err)
-		}
+	executable := make(executableSymbols, len(elfSymbols))
+	for _, symbol := range elfSymbols {
+		executable[symbol.Name] = uintptr(symbol.Value)
+	}
+
+	// position independent executables are loaded at an offset, which
+	// we get by comparing the address of a function with its symbol.
+	anchorPC := funcPC(readExecutableSymbols)
+	anchor, ok := executable[runtime.FuncForPC(anchorPC).Name()]
+	if !ok {
+		return nil, errors.New("could not find own symbol in executable")
+	}
+
+	for name, addr := range executable {
+		executable[name] = addr + (anchorPC - anchor)
+	}
+
+	return executable, nil
+}
+
+func (executable executableSymbols) find(addr *uintptr, name string) error {
+	value, ok := executable[name]
+	if !ok || value == 0 {
+		return fmt.Errorf("could not find symbol '%s' in executable", name)
+	}
+
+	*addr = value
+	return nil
+}
+
+// getFunc sets the function pointed to by fn to the function with the given name.
+func (executable executableSymbols) getFunc(fn interface{}, name string) error {
+	target := reflect.ValueOf(fn)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Func {
+		return fmt.Errorf("expected pointer to function for '%s'", name)
+	}
+
+	// a func value is a pointer to the code pointer of the function
+	codePtr := new(uintptr)
+	if err := executable.find(codePtr, name); err != nil {
+		return err
 	}
 
-	{
-		name := "runtime.gopark"
-		addr, err := forceexport.FindFuncWithName("runtime.gopark")
+	*(*unsafe.Pointer)(unsafe.Pointer(target.Pointer())) = unsafe.Pointer(codePtr)
+	return nil
+}
+
+// getVariable sets the pointer at ptr to the address of the given variable.
+func (executable executableSymbols) getVariable(ptr unsafe.Pointer, name string) error {
+	var addr uintptr
+	if err := executable.find(&addr, name); err != nil {
+		return err
+	}
+
+	*(*uintptr)(ptr) = addr
+	return nil
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
 		if err != nil {
-			log.Fatalln("Could not get function pointer '"+name+"': ", err)
+			return err
 		}
-
-		runtime_gopark = addr
 	}
+
+	return nil
 }
 
-func runtime_getg() *goroutine {
-	return (*goroutine)(g.G())
+// labelLayout describes how the runtime/pprof package stores the labels of a goroutine.
+type labelLayout uint8
+
+const (
+	labelLayoutUnknown labelLayout = iota
+
+	// a map[string]string, as used by older versions of go.
+	labelLayoutMap
+
+	// a struct containing a sorted slice of key value pairs.
+	labelLayoutSlice
+)
+
+// detectLabelLayout finds the type of the labels that the runtime stores for a
+// goroutine. runtime/pprof puts the same pointer into the context, so the
+// type can be inspected by reflection without touching unknown memory.
+func detectLabelLayout() (labelLayout, error) {
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("key", "value"))
+
+	value := reflect.ValueOf(ctx)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+
+	if value.Kind() == reflect.Struct {
+		value = value.FieldByName("val")
+	}
+
+	if !value.IsValid() || value.Kind() != reflect.Interface || value.IsNil() {
+		return labelLayoutUnknown, errors.New("labels not found in context")
+	}
+
+	labelsType := value.Elem().Type()
+	if labelsType.Kind() != reflect.Ptr {
+		return labelLayoutUnknown, fmt.Errorf("unsupported labels type %s", labelsType)
+	}
+
+	stringType := reflect.TypeOf("")
+
+	// follow structs wrapping a single value
+	target := labelsType.Elem()
+	for target.Kind() == reflect.Struct && target.NumField() == 1 {
+		target = target.Field(0).Type
+	}
+
+	switch {
+	case target.Kind() == reflect.Map && target.Key() == stringType && target.Elem() == stringType:
+		return labelLayoutMap, nil
+
+	case target.Kind() == reflect.Slice && target.Elem().Kind() == reflect.Struct &&
+		target.Elem().NumField() == 2 &&
+		target.Elem().Field(0).Type == stringType &&
+		target.Elem().Field(1).Type == stringType:
+
+		return labelLayoutSlice, nil
+	}
+
+	return labelLayoutUnknown, fmt.Errorf("unsupported labels type %s", labelsType)
 }
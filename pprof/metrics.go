@@ -0,0 +1,43 @@
+package pprof
+
+import (
+	"runtime"
+	"time"
+)
+
+// RuntimeMetrics is a snapshot of runtime statistics taken at the end of
+// a window. This allows to correlate a profile with the memory usage and
+// garbage collector activity at the same time.
+type RuntimeMetrics struct {
+	// bytes in in-use heap spans and bytes of allocated heap objects
+	HeapInUse uint64
+	HeapAlloc uint64
+
+	// number of allocated heap objects
+	HeapObjects uint64
+
+	// number of completed gc cycles and the total
+	// stop-the-world pause time since the process started
+	NumGC      uint32
+	PauseTotal time.Duration
+
+	Goroutines int
+	GOMAXPROCS int
+}
+
+// readRuntimeMetrics takes a snapshot of the runtime statistics.
+// Reading the memory statistics briefly stops the world.
+func readRuntimeMetrics() *RuntimeMetrics {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	return &RuntimeMetrics{
+		HeapInUse:   memStats.HeapInuse,
+		HeapAlloc:   memStats.HeapAlloc,
+		HeapObjects: memStats.HeapObjects,
+		NumGC:       memStats.NumGC,
+		PauseTotal:  time.Duration(memStats.PauseTotalNs),
+		Goroutines:  runtime.NumGoroutine(),
+		GOMAXPROCS:  runtime.GOMAXPROCS(0),
+	}
+}
@@ -10,27 +10,161 @@ import (
 
 type MethodId uint32
 
+// SampleKind describes how a sample was captured.
+type SampleKind uint8
+
+const (
+	// The stack was captured by the cpu profiler while
+	// the goroutine was running on a cpu.
+	SampleKindCPU SampleKind = iota
+
+	// The stack was captured from a parked goroutine,
+	// e.g. blocked in I/O or in a channel operation.
+	SampleKindOffCPU
+)
+
+func (kind SampleKind) String() string {
+	switch kind {
+	case SampleKindCPU:
+		return "cpu"
+
+	case SampleKindOffCPU:
+		return "offcpu"
+
+	default:
+		return "unknown"
+	}
+}
+
+// ProfileType describes what kind of data a profile contains.
+type ProfileType uint8
+
+const (
+	// A profile containing cpu samples. Each sample has a duration
+	// that describes the time spent in the samples stack.
+	ProfileTypeCPU ProfileType = iota
+
+	// A profile containing the memory allocations since the previous
+	// window. The samples values are described by the profiles ValueTypes.
+	ProfileTypeHeap
+
+	// A profile containing the contentions on mutexes since the previous window.
+	ProfileTypeMutex
+
+	// A profile containing the time spent blocked on synchronization
+	// primitives since the previous window.
+	ProfileTypeBlock
+
+	// A profile containing the number of goroutines. Some of those
+	// profiles also contain a snapshot of all goroutine stacks.
+	ProfileTypeGoroutine
+)
+
+func (profileType ProfileType) String() string {
+	switch profileType {
+	case ProfileTypeCPU:
+		return "cpu"
+
+	case ProfileTypeHeap:
+		return "heap"
+
+	case ProfileTypeMutex:
+		return "mutex"
+
+	case ProfileTypeBlock:
+		return "block"
+
+	case ProfileTypeGoroutine:
+		return "goroutine"
+
+	default:
+		return "unknown"
+	}
+}
+
 type Sample struct {
 	TimestampNs uint64
 	Duration    time.Duration
 	Stack       []MethodId
 	Labels      map[string]string
+	Kind        SampleKind
+
+	// values of the sample for non cpu profiles. The meaning of
+	// each value is given by the ValueTypes of the profile.
+	Values []int64
 }
 
 type Profile struct {
-	Start   time.Time
+	Type  ProfileType
+	Start time.Time
+
+	// the names of the methods, indexed by their id. The ids are stable for
+	// the lifetime of the process, so the names are shared by all
+	// profiles and must not be modified.
 	Names   []string
 	Samples []Sample
 
+	// the names of the values of each sample, e.g. alloc_bytes.
+	// This is empty for cpu profiles.
+	ValueTypes []string
+
+	// the source file and line of each entry in Names. Those are
+	// only filled if the profile was created with file and line
+	// information enabled.
+	Files []string
+	Lines []int32
+
+	// the number of profiles that were dropped by the Collector
+	// since the last profile was send successfully.
+	DroppedProfiles int
+
+	// the number of cpu samples the runtime could not record during the
+	// window, e.g. because its profile buffer overflowed. Those samples
+	// are attributed to the lostProfileEvent function.
+	LostSamples int
+
+	// how far the wall clock has moved away from the monotonic clock since
+	// the profiler was started. The timestamps of the samples follow the
+	// monotonic clock, so a large drift means that they are off by this
+	// amount compared to the system clock. Only set for cpu profiles.
+	ClockDrift time.Duration
+
+	// the number of goroutines at the end of the window.
+	// Only set for goroutine profiles.
+	Goroutines int
+
+	// a snapshot of the runtime statistics at the end of
+	// the window. Only set for cpu profiles.
+	Metrics *RuntimeMetrics
+
+	// the slowest spans that ended during the window.
+	// Only set for cpu profiles.
+	Spans []SpanRecord
+
+	// the sampling interval of the cpu profiler. A cpu sample stands for
+	// Duration / Period samples taken by the runtime. Only set for cpu profiles.
+	Period time.Duration
+
 	// some meta data to send with the samples
 	ServiceName string
 	InstanceId  uuid.UUID
 	Tags        map[string]string
 
-	baseTimestamp uint64
-	methodCache   map[string]MethodId
-	locationCache map[uintptr]MethodId
-	period        time.Duration
+	clock *clock
+
+	// include file and line of each frame
+	includeLines bool
+
+	// time spent parsing the cpu samples added to this profile.
+	parsing time.Duration
+}
+
+// methodKey identifies a method, or a line in a method if
+// file and line information is included.
+type methodKey struct {
+	Function string
+	File     string
+	Line     int
 }
 
 func (profile *Profile) add(data []uint64, tags []unsafe.Pointer) error {
@@ -38,6 +172,9 @@ func (profile *Profile) add(data []uint64, tags []unsafe.Pointer) error {
 		return nil
 	}
 
+	startTime := time.Now()
+	defer func() { profile.parsing += time.Since(startTime) }()
+
 	if len(data) < 3 || data[0] > uint64(len(data)) {
 		return fmt.Errorf("truncated profile")
 	}
@@ -72,12 +209,8 @@ func (profile *Profile) add(data []uint64, tags []unsafe.Pointer) error {
 			return fmt.Errorf("malformed profile")
 		}
 
-		if profile.baseTimestamp == 0 {
-			profile.baseTimestamp = uint64(time.Now().UnixNano()) - data[1]
-		}
-
 		// get data and advance
-		stampNs := profile.baseTimestamp + data[1]
+		stamp := data[1]
 		count := data[2]
 		stack := data[3:data[0]]
 		data = data[data[0]:]
@@ -88,7 +221,22 @@ func (profile *Profile) add(data []uint64, tags []unsafe.Pointer) error {
 			tag = tags[0]
 			tags = tags[1:]
 		}
-		_ = tag
+
+		if len(stack) == 0 {
+			// header record containing the sample rate,
+			// written when the cpu profiler is started.
+			profile.clock.anchor(stamp)
+			continue
+		}
+
+		// overflow records for lost samples carry the time of the first lost
+		// sample. A stamp of zero is only expected from older runtimes.
+		var stampNs uint64
+		if stamp != 0 {
+			stampNs = profile.clock.unixNanos(stamp)
+		} else {
+			stampNs = uint64(time.Now().UnixNano())
+		}
 
 		if count == 0 && len(stack) == 1 {
 			// overflow record
@@ -96,14 +244,54 @@ func (profile *Profile) add(data []uint64, tags []unsafe.Pointer) error {
 			stack = []uint64{
 				uint64(funcPC(lostProfileEvent)),
 			}
+
+			profile.LostSamples += int(count)
 		}
 
-		profile.addStack(stack, stampNs, profile.period)
+		// each sample stands for count periods
+		duration := time.Duration(count) * profile.Period
+		profile.addStack(stack, stampNs, duration, labelsOf(tag), SampleKindCPU)
 	}
 
 	return nil
 }
 
+// labelsOf decodes the labels that the runtime stored as tag for a
+// sample. The tag points to the labels of the goroutine that were set
+// using runtime/pprof.Do or SetGoroutineLabels. Their layout depends
+// on the version of go, see detectLabelLayout.
+func labelsOf(tag unsafe.Pointer) map[string]string {
+	if tag == nil {
+		return nil
+	}
+
+	switch symbols.labelLayout {
+	case labelLayoutMap:
+		labels := *(*map[string]string)(tag)
+		if len(labels) == 0 {
+			return nil
+		}
+
+		return labels
+
+	case labelLayoutSlice:
+		list := *(*[]struct{ key, value string })(tag)
+		if len(list) == 0 {
+			return nil
+		}
+
+		labels := make(map[string]string, len(list))
+		for _, label := range list {
+			labels[label.key] = label.value
+		}
+
+		return labels
+
+	default:
+		return nil
+	}
+}
+
 // lostProfileEvent is the function to which lost profiling
 // events are attributed.
 // (The name shows up in the pprof graphs.)
@@ -114,56 +302,35 @@ func funcPC(f interface{}) uintptr {
 	return *(*[2]*uintptr)(unsafe.Pointer(&f))[1]
 }
 
-// locForPC returns the lookup id of the function for addr.
-// addr must a return PC or 1 + the PC of an inline marker.
-// This returns the location of the corresponding call.
-func (profile *Profile) locForPC(addr uintptr) MethodId {
-	if loc, ok := profile.locationCache[addr]; ok {
-		return loc
-	}
-
-	// Expand this one address using CallersFrames so we can cache
-	// each expansion. In general, CallersFrames takes a whole
-	// stack, but in this case we know there will be no skips in
-	// the stack and we have return PCs anyway.
-	frames := runtime.CallersFrames([]uintptr{addr})
-
-	frame, _ := frames.Next()
-	if frame.Function == "runtime.goexit" {
-		// Short-circuit if we see runtime.goexit so the loop
-		// below doesn't allocate a useless empty location.
-		return 0
-	}
+// locForPC returns the ids of the methods at addr, innermost
+// (leaf) frame first, see symbolTable.locForPC.
+func (profile *Profile) locForPC(addr uintptr) []MethodId {
+	loc := processSymbols.locForPC(addr, profile.includeLines)
+	profile.updateNames()
+	return loc
+}
 
-	var mId MethodId
+// methodId returns the id of the method of the given frame,
+// registering the method if it was not seen before.
+func (profile *Profile) methodId(frame runtime.Frame) MethodId {
+	methodId := processSymbols.methodId(frame, profile.includeLines)
+	profile.updateNames()
+	return methodId
+}
 
-	// check if we already know the function
-	cachedMethodId, ok := profile.methodCache[frame.Function]
-	if ok {
-		mId = cachedMethodId
-	} else {
-		// method not known, cache it
-		methodId := MethodId(len(profile.Names))
-		profile.methodCache[frame.Function] = methodId
-		profile.Names = append(profile.Names, frame.Function)
+// updateNames updates the names of the profile to include all
+// methods that are known to the symbol table of the process.
+func (profile *Profile) updateNames() {
+	names, files, lines := processSymbols.snapshot()
 
-		mId = methodId
+	profile.Names = names
+	if profile.includeLines {
+		profile.Files = files
+		profile.Lines = lines
 	}
-
-	// cache location by address
-	profile.locationCache[addr] = mId
-
-	return mId
-
-	// TODO expand inlined functions correctly,
-	//  (loop, multiple frames can have the same PC)
-	// if !more {
-	// 	break
-	// }
-	// frame, more = frames.Next()
 }
 
-func (profile *Profile) addStack(stack []uint64, stampNs uint64, duration time.Duration) {
+func (profile *Profile) addStack(stack []uint64, stampNs uint64, duration time.Duration, labels map[string]string, kind SampleKind) {
 	var loc []MethodId
 	for i := len(stack) - 1; i >= 0; i-- {
 		addr := stack[i]
@@ -178,21 +345,67 @@ func (profile *Profile) addStack(stack []uint64, stampNs uint64, duration time.D
 			addr++
 		}
 
-		l := profile.locForPC(uintptr(addr))
-		if l == 0 {
-			continue
+		loc = profile.appendLocations(loc, uintptr(addr))
+	}
+
+	if len(loc) > 0 {
+		sample := Sample{
+			TimestampNs: stampNs,
+			Duration:    duration,
+			Stack:       loc,
+			Labels:      labels,
+			Kind:        kind,
 		}
 
-		loc = append(loc, l)
+		profile.Samples = append(profile.Samples, sample)
+	}
+
+	profile.updateNames()
+}
+
+// addValues adds a sample with the given values to the profile. The
+// stack must contain return PCs, ordered leaf first, as returned by
+// runtime.MemProfile and similar functions.
+func (profile *Profile) addValues(stack []uintptr, stampNs uint64, values []int64) {
+	var loc []MethodId
+	for i := len(stack) - 1; i >= 0; i-- {
+		loc = profile.appendLocations(loc, stack[i])
 	}
 
 	if len(loc) > 0 {
 		sample := Sample{
 			TimestampNs: stampNs,
-			Duration:    duration,
 			Stack:       loc,
+			Values:      values,
 		}
 
 		profile.Samples = append(profile.Samples, sample)
 	}
+
+	profile.updateNames()
+}
+
+// appendLocations appends the frames at addr to loc. The frames
+// are ordered leaf first, but we build the stack from the root,
+// so add them in reverse.
+func (profile *Profile) appendLocations(loc []MethodId, addr uintptr) []MethodId {
+	frames := processSymbols.locForPC(addr, profile.includeLines)
+	for idx := len(frames) - 1; idx >= 0; idx-- {
+		loc = append(loc, frames[idx])
+	}
+
+	return loc
+}
+
+// estimatedSize returns a rough estimate of the memory used by this
+// profile in bytes. The names are shared with the symbol table of the
+// process and are not included.
+func (profile *Profile) estimatedSize() int {
+	size := 256
+
+	for _, sample := range profile.Samples {
+		size += 64 + 4*len(sample.Stack) + 8*len(sample.Values)
+	}
+
+	return size
 }
@@ -1,6 +1,7 @@
 package pprof
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
@@ -16,6 +17,14 @@ type Config struct {
 	Sender Sender
 	Logger Logger
 
+	// Configures retries if the Sender fails to send a profile.
+	Retry RetryConfig
+
+	// The maximum size of all profiles waiting to be send in bytes.
+	// If the limit is reached, the oldest profiles are dropped.
+	// Defaults to 8MB.
+	MaxBufferSize int
+
 	ServiceName string
 	Tags        map[string]string
 
@@ -28,12 +37,128 @@ type Config struct {
 	// system, and a nice round number to make it easy to
 	// convert sample counts to seconds.
 	SampleFrequencyHz int
+
+	// Enables adaptive sampling. After each window the sample frequency is
+	// adjusted, so that the time spent processing and encoding profiles stays
+	// below this fraction of one cpu core, e.g. 0.01 for 1%. SampleFrequencyHz
+	// is then used as the maximum frequency. Zero disables adaptive sampling.
+	OverheadBudget float64
+
+	// The minimum sample frequency if adaptive sampling is enabled.
+	// Defaults to 10.
+	MinSampleFrequencyHz int
+
+	// Raises the sample frequency for a short time if the cpu usage
+	// of the process is high. Adaptive sampling is suspended
+	// during a burst. See BurstConfig.
+	Burst BurstConfig
+
+	// The interval in which the cpu samples are read from the runtime.
+	// Defaults to 100ms.
+	ReadInterval time.Duration
+
+	// The length of a profile window. All samples of a window are collected
+	// into one profile that is then send using the Sender. Defaults to 2s.
+	WindowDuration time.Duration
+
+	// A random duration between zero and WindowJitter is added to each window.
+	// This prevents a large number of instances from sending their
+	// profiles at the same time. Defaults to zero.
+	WindowJitter time.Duration
+
+	// Include the source file and line of each frame. This allows to see
+	// which line of a function is hot, but increases the size of the profiles.
+	IncludeLines bool
+
+	// Enables wall clock profiling. In addition to the cpu samples, a random
+	// selection of goroutines is captured once per window. Stacks of goroutines
+	// that are parked (e.g. waiting for I/O, a channel or a lock) are then
+	// recorded as off-cpu samples.
+	WallClock bool
+
+	// The number of goroutines to capture per window if wall clock
+	// profiling is enabled. Defaults to 16.
+	WallClockSampleCount int
+
+	// Enables heap profiling. Once per window the memory profile of the
+	// runtime is read and the allocations since the previous window are
+	// sent as a separate heap profile.
+	HeapProfile bool
+
+	// Enables mutex profiling by calling runtime.SetMutexProfileFraction
+	// with this value. On average 1/n of the mutex contention events are
+	// reported. The contentions since the previous window are sent as a
+	// separate mutex profile. Zero disables mutex profiling.
+	MutexProfileFraction int
+
+	// Enables block profiling by calling runtime.SetBlockProfileRate
+	// with this value. The profiler aims to sample an average of one
+	// blocking event per n nanoseconds spent blocked. The blocking events
+	// since the previous window are sent as a separate block profile.
+	// Zero disables block profiling.
+	BlockProfileRate int
+
+	// Enables goroutine profiling. The number of goroutines is recorded
+	// every window, and every GoroutineSnapshotWindows windows a snapshot
+	// of all goroutine stacks is taken. A snapshot contains the number of
+	// goroutines of each stack at that moment, so snapshots must not be
+	// added up. The server shows the latest snapshot of each instance.
+	GoroutineProfile bool
+
+	// The number of windows between two goroutine snapshots. Taking a
+	// snapshot stops the world, so this should not be too small.
+	// Defaults to 30.
+	GoroutineSnapshotWindows int
+
+	// The maximum number of finished spans that are sent with each cpu
+	// profile, see Span. If more spans finish during a window, the
+	// slowest spans are kept. Defaults to 256, a negative
+	// value disables recording of spans.
+	SpanBufferSize int
+
+	// Fetches settings that change the configuration of the running
+	// profiler, e.g. from the ingest service. See Settings.
+	SettingsSource SettingsSource
+
+	// The interval in which the settings are fetched
+	// from the SettingsSource. Defaults to 30s.
+	SettingsPollInterval time.Duration
 }
 
+var (
+	// ErrProfilerActive is returned by Start if a profiler is already running.
+	ErrProfilerActive = errors.New("profiler already active")
+
+	// ErrProfilerStopped is returned if a profiler is used after it was stopped.
+	ErrProfilerStopped = errors.New("profiler is stopped")
+)
+
 var cpu struct {
 	sync.Mutex
 
 	profiler *profiler
+
+	// the done channel of the last stopped profiler. Its loop might
+	// still read the cpu profiler after Stop has returned.
+	stopped chan bool
+}
+
+// Profiler controls a running profiler.
+type Profiler interface {
+	// Pause releases the cpu profiler of the runtime, so that another tool,
+	// e.g. runtime/pprof.StartCPUProfile, can use it. Other profile types
+	// are still collected. Pause returns once the cpu profiler is released.
+	Pause() error
+
+	// Resume restarts the cpu profiler after Pause. The other tool
+	// must have stopped its cpu profile before, otherwise an error
+	// is returned and the profiler stays paused.
+	Resume() error
+
+	// Stop stops the profiler and sends all pending profiles. It waits
+	// until the profiles are send or the context is done. Once
+	// stopped, a new profiler can be started.
+	Stop(ctx context.Context) error
 }
 
 type profiler struct {
@@ -42,123 +167,603 @@ type profiler struct {
 	instanceId uuid.UUID
 	done       chan bool
 
+	// closed when the profiler is stopped
+	closing chan struct{}
+
+	// the configuration the profiler was started with. Remote
+	// settings are applied on top of this configuration.
+	local Config
+
+	// the settings currently in effect and the settings received from the
+	// SettingsSource that were not yet applied by the loop.
+	settings        Settings
+	settingsLock    sync.Mutex
+	pendingSettings *Settings
+
+	// the sample frequency currently in effect. This might differ from the
+	// configured one if adaptive sampling is enabled, and is zero if
+	// the cpu profiler is disabled by the settings.
+	sampleFrequencyHz int
+
+	// starts the cpu profiler and reads its samples.
+	cpuProfiler cpuProfiler
+
+	// converts the timestamps of the cpu samples to wall clock time.
+	// Only accessed by the loop after the profiler was started.
+	clock clock
+
+	// detects spikes in cpu usage if burst profiling is enabled.
+	// Only accessed by the loop.
+	burst burstDetector
+
+	// guards changes of the cpu profile rate against a concurrent Stop or Pause.
+	rateLock sync.Mutex
+	stopping bool
+	paused   bool
+
+	// closed by the loop once it released the cpu profiler after Pause.
+	released chan struct{}
+
+	// the sample frequency to restart the cpu profiler with after Resume.
+	// Only accessed by the loop.
+	resumeFrequencyHz int
+
 	collector *Collector
+
+	// additional profiles that are collected once per window,
+	// e.g. a heap or mutex profile.
+	valueProfilers []valueProfiler
 }
 
-func Start(config Config) Stopper {
+// valueProfiler collects a profile with samples that have values instead of
+// a duration. The profile is collected once per window.
+type valueProfiler interface {
+	profileType() ProfileType
+	valueTypes() []string
+	collect(profile *Profile)
+}
+
+// Start starts profiling with the given configuration. Only one
+// profiler can be active at a time.
+func Start(config Config) (Profiler, error) {
 	if config.SampleFrequencyHz == 0 {
 		config.SampleFrequencyHz = 100
 	}
 
+	if config.MinSampleFrequencyHz == 0 {
+		config.MinSampleFrequencyHz = 10
+	}
+
+	if config.Burst.After == 0 {
+		config.Burst.After = time.Second
+	}
+
+	if config.Burst.SampleFrequencyHz == 0 {
+		config.Burst.SampleFrequencyHz = 250
+	}
+
+	if config.Burst.Length == 0 {
+		config.Burst.Length = 10 * time.Second
+	}
+
+	if config.ReadInterval == 0 {
+		config.ReadInterval = 100 * time.Millisecond
+	}
+
+	if config.WindowDuration == 0 {
+		config.WindowDuration = 2 * time.Second
+	}
+
+	if config.WallClockSampleCount == 0 {
+		config.WallClockSampleCount = 16
+	}
+
+	if config.GoroutineSnapshotWindows == 0 {
+		config.GoroutineSnapshotWindows = 30
+	}
+
+	if config.SpanBufferSize == 0 {
+		config.SpanBufferSize = 256
+	}
+
+	if config.SettingsPollInterval == 0 {
+		config.SettingsPollInterval = 30 * time.Second
+	}
+
 	if config.Logger == nil {
 		config.Logger = func(format string, args ...interface{}) {
 			fmt.Println(fmt.Sprintf(format, args...))
 		}
 	}
 
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	cpu.Lock()
 	defer cpu.Unlock()
 
-	// Double-check .
 	if cpu.profiler != nil {
-		panic(errors.New("cpu profiling already active"))
+		return nil, ErrProfilerActive
+	}
+
+	if cpu.stopped != nil {
+		// wait for the loop of the previous profiler to read its last samples
+		<-cpu.stopped
+		cpu.stopped = nil
+	}
+
+	var cpuProfiler cpuProfiler = &runtimeCPUProfiler{}
+	if symbols.readProfile != nil {
+		config.Logger("Reading cpu samples from the runtime is not supported, using runtime/pprof: %s", symbols.readProfile)
+
+		// runtime/pprof uses a fixed sample frequency
+		config.SampleFrequencyHz = pprofSampleFrequencyHz
+		config.OverheadBudget = 0
+		config.Burst.Threshold = 0
+
+		cpuProfiler = &pprofCPUProfiler{}
+	} else if symbols.labels != nil {
+		config.Logger("Labels of cpu samples are not supported, samples are not attributed to spans: %s", symbols.labels)
 	}
 
-	runtime.SetCPUProfileRate(config.SampleFrequencyHz)
+	var cyclesPerSecond int64
+	if config.MutexProfileFraction > 0 || config.BlockProfileRate > 0 {
+		var err error
+		if cyclesPerSecond, err = contentionCyclesPerSecond(); err != nil {
+			config.Logger("Contention profiling is not supported, mutex and block profiles are disabled: %s", err)
+
+			config.MutexProfileFraction = 0
+			config.BlockProfileRate = 0
+		}
+	}
+
+	// the runtime takes the timestamp of its header record while
+	// starting the profiler, so use the middle of both times.
+	beforeStart := time.Now()
+	if err := cpuProfiler.start(config.SampleFrequencyHz); err != nil {
+		return nil, fmt.Errorf("start cpu profiler: %s", err)
+	}
+
+	startTime := beforeStart.Add(time.Since(beforeStart) / 2)
 
 	profiler := &profiler{
-		Config:     config,
-		instanceId: uuid.New(),
-		done:       make(chan bool),
-		collector:  NewCollector(config.Sender, config.Logger),
+		Config:            config,
+		instanceId:        uuid.New(),
+		done:              make(chan bool),
+		closing:           make(chan struct{}),
+		local:             config,
+		settings:          Settings{Enabled: true},
+		cpuProfiler:       cpuProfiler,
+		burst:             burstDetector{BurstConfig: config.Burst},
+		clock:             clock{start: startTime},
+		sampleFrequencyHz: config.SampleFrequencyHz,
+		collector: NewCollectorWithConfig(CollectorConfig{
+			Sender:        config.Sender,
+			Logger:        config.Logger,
+			Retry:         config.Retry,
+			MaxBufferSize: config.MaxBufferSize,
+		}),
+	}
+
+	if config.HeapProfile {
+		profiler.valueProfilers = append(profiler.valueProfilers, newHeapProfiler())
+	}
+
+	if config.MutexProfileFraction > 0 {
+		runtime.SetMutexProfileFraction(config.MutexProfileFraction)
+		profiler.valueProfilers = append(profiler.valueProfilers, newMutexProfiler(config.MutexProfileFraction, cyclesPerSecond))
+	}
+
+	if config.BlockProfileRate > 0 {
+		runtime.SetBlockProfileRate(config.BlockProfileRate)
+		profiler.valueProfilers = append(profiler.valueProfilers, newBlockProfiler(cyclesPerSecond))
+	}
+
+	if config.GoroutineProfile {
+		profiler.valueProfilers = append(profiler.valueProfilers, newGoroutineProfiler(config.GoroutineSnapshotWindows))
 	}
 
+	spans.enable(config.SpanBufferSize)
+
 	go profiler.loop()
 
-	return profiler
+	if config.SettingsSource != nil {
+		go profiler.pollSettings()
+	}
+
+	cpu.profiler = profiler
+
+	return profiler, nil
+}
+
+// validate checks the config for invalid values. Defaults
+// must have been applied before.
+func (config *Config) validate() error {
+	switch {
+	case config.SampleFrequencyHz < 0:
+		return fmt.Errorf("sample frequency must not be negative, got %d", config.SampleFrequencyHz)
+
+	case config.OverheadBudget < 0 || config.OverheadBudget > 1:
+		return fmt.Errorf("overhead budget must be between 0 and 1, got %f", config.OverheadBudget)
+
+	case config.OverheadBudget > 0 && config.MinSampleFrequencyHz > config.SampleFrequencyHz:
+		return fmt.Errorf("minimum sample frequency %d must not be larger than the sample frequency %d",
+			config.MinSampleFrequencyHz, config.SampleFrequencyHz)
+
+	case config.Burst.Threshold < 0:
+		return fmt.Errorf("burst threshold must not be negative, got %f", config.Burst.Threshold)
+
+	case config.Burst.Threshold > 0 && (config.Burst.After < 0 || config.Burst.Length <= 0):
+		return fmt.Errorf("burst delay %s must not be negative and burst length %s must be positive",
+			config.Burst.After, config.Burst.Length)
+
+	case config.Burst.Threshold > 0 && config.Burst.SampleFrequencyHz < config.SampleFrequencyHz:
+		return fmt.Errorf("burst sample frequency %d must not be lower than the sample frequency %d",
+			config.Burst.SampleFrequencyHz, config.SampleFrequencyHz)
+
+	case config.ReadInterval <= 0:
+		return fmt.Errorf("read interval must be positive, got %s", config.ReadInterval)
+
+	case config.WindowDuration < config.ReadInterval:
+		return fmt.Errorf("window duration %s must not be shorter than the read interval %s",
+			config.WindowDuration, config.ReadInterval)
+
+	case config.WindowJitter < 0:
+		return fmt.Errorf("window jitter must not be negative, got %s", config.WindowJitter)
+
+	case config.WindowJitter > config.WindowDuration:
+		return fmt.Errorf("window jitter %s must not be longer than the window duration %s",
+			config.WindowJitter, config.WindowDuration)
+
+	case config.SettingsPollInterval < 0:
+		return fmt.Errorf("settings poll interval must not be negative, got %s", config.SettingsPollInterval)
+	}
+
+	if config.Burst.Threshold > 0 {
+		if _, err := processCPUTime(); err != nil {
+			return fmt.Errorf("burst profiling not supported: %s", err)
+		}
+	}
+
+	resolveSymbols()
+
+	if config.WallClock && symbols.wallClock != nil {
+		return fmt.Errorf("wall clock profiling not supported: %s", symbols.wallClock)
+	}
+
+	return nil
 }
 
 func (p *profiler) loop() {
 	defer close(p.done)
 
 	var profile *Profile
+	var windowDuration time.Duration
+
+	// time spent collecting stacks and values in the current window,
+	// without the parsing of cpu samples, see Profile.parsing.
+	var processing time.Duration
+
+	// true if the cpu profiler was running during the current window
+	var cpuActive bool
+
 	for {
 		if profile == nil {
-			profile = &Profile{
-				Start:       time.Now(),
-				ServiceName: p.ServiceName,
-				InstanceId:  p.instanceId,
-				Tags:        p.Tags,
+			profile = p.newProfile(ProfileTypeCPU, time.Now())
+			if p.sampleFrequencyHz > 0 {
+				profile.Period = time.Duration(1e9 / p.sampleFrequencyHz)
+			}
+
+			windowDuration = p.windowDuration()
+			processing = 0
+			cpuActive = false
+		}
+
+		time.Sleep(p.ReadInterval)
 
-				methodCache:   make(map[string]MethodId),
-				locationCache: make(map[uintptr]MethodId),
+		if p.sampleFrequencyHz > 0 {
+			cpuActive = true
 
-				period: time.Duration(1e9 / p.Config.SampleFrequencyHz),
+			eof, err := p.cpuProfiler.read(profile)
+			if err != nil {
+				log.Println("Process profile data:", err)
 			}
-		}
 
-		time.Sleep(100 * time.Millisecond)
+			if eof && !p.releaseProfiler() {
+				break
+			}
+		} else if !p.releaseProfiler() {
+			break
+		} else if p.resumeFrequencyHz > 0 && !p.isPaused() {
+			hz := p.resumeFrequencyHz
+			p.resumeFrequencyHz = 0
+
+			if !p.changeSampleFrequency(profile, hz) {
+				break
+			}
 
-		data, tags, eof := runtime_pprof_readProfile()
-		if err := profile.add(data, tags); err != nil {
-			log.Println("Process profile data:", err)
+			// the window might have started while the cpu profiler was released
+			if profile.Period == 0 && p.sampleFrequencyHz > 0 {
+				profile.Period = time.Duration(1e9 / p.sampleFrequencyHz)
+			}
 		}
 
-		if eof {
-			break
+		var burstChanged bool
+		if p.Burst.Threshold > 0 && p.sampleFrequencyHz > 0 {
+			changed, err := p.burst.update(time.Now())
+			if err != nil {
+				p.Logger("Measure cpu usage: %s", err)
+			}
+
+			burstChanged = changed
 		}
 
-		if time.Since(profile.Start) >= 2*time.Second {
-			// p.captureMoreStacks(profile)
+		// a burst starts or ends with a new window, so that
+		// only the profiles recorded during a burst are tagged.
+		if burstChanged || time.Since(profile.Start) >= windowDuration {
+			if p.sampleFrequencyHz > 0 {
+				eof, err := p.cpuProfiler.flush(profile)
+				if err != nil {
+					log.Println("Process profile data:", err)
+				}
+
+				if eof && !p.releaseProfiler() {
+					break
+				}
+			}
+
+			startTime := time.Now()
+
+			if p.WallClock && p.sampleFrequencyHz > 0 {
+				p.captureMoreStacks(profile)
+			}
 
-			if err := p.collector.Enqueue(profile); err != nil {
-				log.Println("Enqueue profile to collector:", err)
+			for _, valueProfiler := range p.valueProfilers {
+				if p.profileTypeEnabled(valueProfiler.profileType()) {
+					p.collectValues(valueProfiler, profile.Start)
+				}
+			}
+
+			processing += time.Since(startTime)
+
+			adaptive := p.OverheadBudget > 0 && p.sampleFrequencyHz > 0 && !p.burst.active() && !burstChanged
+			if adaptive && !p.adaptSampleFrequency(profile, processing+profile.parsing) {
+				// profiler was stopped
+				break
+			}
+
+			if settings := p.takeSettings(); settings != nil && !p.applySettings(profile, settings) {
+				// profiler was stopped
+				break
+			}
+
+			if p.Burst.Threshold > 0 && !p.updateBurst(profile, burstChanged) {
+				// profiler was stopped
+				break
+			}
+
+			if cpuActive {
+				profile.Metrics = readRuntimeMetrics()
+				profile.Spans = spans.take()
+				profile.ClockDrift = p.clock.drift(time.Now())
+
+				if err := p.collector.Enqueue(profile); err != nil {
+					log.Println("Enqueue profile to collector:", err)
+				}
 			}
 
 			profile = nil
 		}
 	}
 
+	if cpuActive {
+		profile.Metrics = readRuntimeMetrics()
+		profile.Spans = spans.take()
+		profile.ClockDrift = p.clock.drift(time.Now())
+
+		if err := p.collector.Enqueue(profile); err != nil {
+			log.Println("Enqueue profile to collector:", err)
+		}
+	}
+}
+
+// releaseProfiler is called by the loop when the cpu profiler of the runtime
+// has stopped or is not running. If the profiler was paused, the cpu profiler
+// is marked as released and Pause is notified. It returns false, if the
+// profiler was stopped.
+func (p *profiler) releaseProfiler() bool {
+	p.rateLock.Lock()
+	defer p.rateLock.Unlock()
+
+	if p.stopping {
+		return false
+	}
+
+	if p.sampleFrequencyHz > 0 {
+		p.resumeFrequencyHz = p.sampleFrequencyHz
+		p.sampleFrequencyHz = 0
+	}
+
+	if p.released != nil {
+		close(p.released)
+		p.released = nil
+	}
+
+	return true
+}
+
+// isPaused returns true, if the profiler was paused.
+func (p *profiler) isPaused() bool {
+	p.rateLock.Lock()
+	defer p.rateLock.Unlock()
+
+	return p.paused
+}
+
+// windowDuration returns the duration of the next window
+// including a random jitter.
+func (p *profiler) windowDuration() time.Duration {
+	if p.WindowJitter <= 0 {
+		return p.WindowDuration
+	}
+
+	return p.WindowDuration + time.Duration(rand.Int63n(int64(p.WindowJitter)))
+}
+
+// newProfile creates a new and empty profile of the given type.
+func (p *profiler) newProfile(profileType ProfileType, start time.Time) *Profile {
+	tags := p.Tags
+	if p.burst.active() {
+		tags = withBurstTag(tags)
+	}
+
+	return &Profile{
+		Type:        profileType,
+		Start:       start,
+		ServiceName: p.ServiceName,
+		InstanceId:  p.instanceId,
+		Tags:        tags,
+
+		clock:        &p.clock,
+		includeLines: p.IncludeLines,
+	}
+}
+
+// collectValues enqueues a profile collected by the given value profiler,
+// e.g. a heap profile with all allocations since the previous window.
+func (p *profiler) collectValues(valueProfiler valueProfiler, start time.Time) {
+	profile := p.newProfile(valueProfiler.profileType(), start)
+	profile.ValueTypes = valueProfiler.valueTypes()
+
+	valueProfiler.collect(profile)
+
 	if err := p.collector.Enqueue(profile); err != nil {
-		log.Println("Enqueue profile to collector:", err)
+		log.Printf("Enqueue %s profile to collector: %s", profile.Type, err)
+	}
+}
+
+func (p *profiler) Pause() error {
+	cpu.Lock()
+	defer cpu.Unlock()
+
+	if cpu.profiler != p {
+		return ErrProfilerStopped
 	}
+
+	p.rateLock.Lock()
+	if p.paused {
+		p.rateLock.Unlock()
+		return nil
+	}
+
+	released := make(chan struct{})
+
+	p.paused = true
+	p.released = released
+	p.cpuProfiler.stop()
+	p.rateLock.Unlock()
+
+	// wait for the loop to read the remaining samples
+	<-released
+
+	return nil
 }
 
-type Stopper interface {
-	Stop()
+func (p *profiler) Resume() error {
+	cpu.Lock()
+	defer cpu.Unlock()
+
+	if cpu.profiler != p {
+		return ErrProfilerStopped
+	}
+
+	p.rateLock.Lock()
+	defer p.rateLock.Unlock()
+
+	if p.paused && p.released == nil {
+		// the cpu profiler was released by the loop, check that
+		// the other tool is done before the loop restarts it.
+		if err := checkCPUProfilerAvailable(); err != nil {
+			return err
+		}
+	}
+
+	p.paused = false
+
+	return nil
 }
 
-// StopCPUProfile stops the current CPU profile, if any.
-// StopCPUProfile only returns after all the writes for the
-// profile have completed.
-func (p *profiler) Stop() {
+// Stop stops the cpu profiler and waits for the loop to send the remaining
+// samples to the collector. The collector is then closed, sending all
+// pending profiles until the context is done.
+func (p *profiler) Stop(ctx context.Context) error {
 	cpu.Lock()
 	defer cpu.Unlock()
 
 	if cpu.profiler != p {
-		return
+		return ErrProfilerStopped
 	}
 
+	// the next profiler can only start once the loop is done
 	cpu.profiler = nil
-	runtime.SetCPUProfileRate(0)
+	cpu.stopped = p.done
+
+	p.rateLock.Lock()
+	p.stopping = true
+	if !p.paused {
+		// if paused, the cpu profiler might be used by someone else
+		p.cpuProfiler.stop()
+	}
+	p.rateLock.Unlock()
+
+	close(p.closing)
+
+	if p.MutexProfileFraction > 0 {
+		runtime.SetMutexProfileFraction(0)
+	}
+
+	if p.BlockProfileRate > 0 {
+		runtime.SetBlockProfileRate(0)
+	}
 
-	<-p.done
+	var err error
 
-	_ = p.collector.Close()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	spans.enable(0)
+
+	if closeErr := p.collector.CloseContext(ctx); err == nil {
+		err = closeErr
+	}
+
+	return err
 }
 
+// captureMoreStacks samples a random selection of goroutines and adds the
+// stacks of all parked goroutines as off-cpu samples to the profile. Each
+// stack is weighted by the inverse of the sampling probability, so that the
+// sum of all off-cpu samples estimates the total time spent parked
+// during the profiles window.
 func (p *profiler) captureMoreStacks(profile *Profile) {
-	var stacks []runtime.StackRecord
-
 	startTime := time.Now()
 
-	var stackSample [16]runtime.StackRecord
+	stackSample := make([]runtime.StackRecord, p.WallClockSampleCount)
+
+	f := sampleGoroutines(stackSample)
+	if f == 0 {
+		return
+	}
 
-	f := sampleGoroutines(stackSample[:])
-	fmt.Println(f)
+	// each captured goroutine stands for 1/f goroutines that were
+	// parked for the whole window.
+	duration := time.Duration(float64(startTime.Sub(profile.Start)) / f)
 
-	var parked int
-	for _, stack := range stackSample[:] {
+	for _, stack := range stackSample {
 		stackAsUint := stack.Stack()
 
 		if len(stackAsUint) == 0 {
@@ -172,41 +777,54 @@ func (p *profiler) captureMoreStacks(profile *Profile) {
 		}
 
 		loc := profile.locForPC(pc)
-		if profile.Names[loc] != "runtime.gopark" {
+		if len(loc) == 0 || profile.Names[loc[0]] != "runtime.gopark" {
 			continue
 		}
 
-		parked++
-
-		// calculate time probability
-		duration := time.Duration((2.0 / f) * float64(time.Second))
-
 		stackSlice := *(*[]uint64)(unsafe.Pointer(&stackAsUint))
-		profile.addStack(stackSlice, uint64(time.Now().UnixNano()), duration)
+		profile.addStack(stackSlice, uint64(startTime.UnixNano()), duration, nil, SampleKindOffCPU)
 	}
-
-	p.Logger("Time to capture goroutine profile: %s", time.Since(startTime))
-	p.Logger("Got %d parked stack traces out of %d", parked, len(stacks))
 }
 
 func sampleGoroutines(records []runtime.StackRecord) float64 {
-	currentGp := runtime_getg()
+	// resolveSymbols made sure that this does not fail
+	currentGp, _ := runtime_getg()
 
 	r := rand.NewSource(time.Now().UnixNano())
 
 	runtime_stopTheWorld("profile")
 
-	result := float64(len(records)) / float64(len(runtime_allgs))
+	// like the goroutine profile of the runtime, skip the current goroutine,
+	// unused goroutines and goroutines of the runtime itself.
+	sampleable := func(gp *goroutine) bool {
+		return gp != currentGp && goroutineStatus(gp) != goroutineStatusDead && !runtime_isSystemGoroutine(gp, false)
+	}
 
-	for i := range records {
-		gpIndex := int(r.Int63()) % len(runtime_allgs)
-		gp := runtime_allgs[gpIndex]
+	allgs := *runtime_allgs
 
-		if currentGp == gp {
-			continue
+	var count int
+	for _, gp := range allgs {
+		if sampleable(gp) {
+			count++
 		}
+	}
 
-		runtime_saveg(^uintptr(0), ^uintptr(0), gp, &records[i])
+	if count == 0 {
+		runtime_startTheWorld()
+		return 0
+	}
+
+	result := float64(len(records)) / float64(count)
+
+	for i := range records {
+		// draw until we hit a goroutine we can sample. There is at least one.
+		for {
+			gp := allgs[int(r.Int63())%len(allgs)]
+			if sampleable(gp) {
+				runtime_saveg(^uintptr(0), ^uintptr(0), gp, &records[i])
+				break
+			}
+		}
 	}
 
 	runtime_startTheWorld()
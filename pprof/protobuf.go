@@ -0,0 +1,423 @@
+package pprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"time"
+)
+
+// the name of the function to which runtime/pprof attributes lost samples.
+const pprofLostProfileEvent = "runtime/pprof.lostProfileEvent"
+
+// addProtobuf adds the samples of a cpu profile in the profile.proto format,
+// as written by runtime/pprof.StartCPUProfile. The profile does not contain
+// the timestamps of the single samples, so all samples get the end time of
+// the profile as their timestamp.
+func (profile *Profile) addProtobuf(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	startTime := time.Now()
+	defer func() { profile.parsing += time.Since(startTime) }()
+
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("decompress profile: %s", err)
+		}
+
+		data, err = ioutil.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("decompress profile: %s", err)
+		}
+	}
+
+	var parsed protoProfile
+	if err := parsed.parse(data); err != nil {
+		return fmt.Errorf("parse profile: %s", err)
+	}
+
+	stampNs := uint64(time.Now().UnixNano())
+	if parsed.timeNanos > 0 {
+		stampNs = uint64(parsed.timeNanos + parsed.durationNanos)
+	}
+
+	// the index of the value containing the cpu time of a sample
+	cpuIndex := -1
+	for idx, sampleType := range parsed.sampleTypes {
+		if parsed.string(sampleType) == "cpu" {
+			cpuIndex = idx
+		}
+	}
+
+	for _, sample := range parsed.samples {
+		var duration time.Duration
+		switch {
+		case cpuIndex >= 0 && cpuIndex < len(sample.values):
+			duration = time.Duration(sample.values[cpuIndex])
+
+		case len(sample.values) > 0:
+			duration = time.Duration(sample.values[0] * parsed.period)
+		}
+
+		// locations are ordered leaf first, but we build the stack from the root
+		var loc []MethodId
+		for i := len(sample.locationIds) - 1; i >= 0; i-- {
+			lines := parsed.locations[sample.locationIds[i]]
+
+			// inlined functions come first, the caller last
+			for j := len(lines) - 1; j >= 0; j-- {
+				function := parsed.functions[lines[j].functionId]
+
+				frame := runtime.Frame{
+					Function: parsed.string(function.name),
+					File:     parsed.string(function.filename),
+					Line:     int(lines[j].line),
+				}
+
+				if frame.Function == "" || frame.Function == "runtime.goexit" {
+					continue
+				}
+
+				loc = append(loc, profile.methodId(frame))
+			}
+		}
+
+		if len(loc) == 0 {
+			continue
+		}
+
+		if profile.Names[loc[len(loc)-1]] == pprofLostProfileEvent && len(sample.values) > 0 {
+			profile.LostSamples += int(sample.values[0])
+		}
+
+		var labels map[string]string
+		for _, label := range sample.labels {
+			if label.str == 0 {
+				// numeric labels are not supported
+				continue
+			}
+
+			if labels == nil {
+				labels = map[string]string{}
+			}
+
+			labels[parsed.string(label.key)] = parsed.string(label.str)
+		}
+
+		profile.Samples = append(profile.Samples, Sample{
+			TimestampNs: stampNs,
+			Duration:    duration,
+			Stack:       loc,
+			Labels:      labels,
+			Kind:        SampleKindCPU,
+		})
+	}
+
+	return nil
+}
+
+// protoProfile contains the parts of a profile.proto message
+// that are required to convert it into a Profile.
+type protoProfile struct {
+	strings     []string
+	sampleTypes []int64
+	samples     []protoSample
+	locations   map[uint64][]protoLine
+	functions   map[uint64]protoFunction
+
+	timeNanos     int64
+	durationNanos int64
+	period        int64
+}
+
+type protoSample struct {
+	locationIds []uint64
+	values      []int64
+	labels      []protoLabel
+}
+
+type protoLabel struct {
+	key int64
+	str int64
+}
+
+type protoLine struct {
+	functionId uint64
+	line       int64
+}
+
+type protoFunction struct {
+	name     int64
+	filename int64
+}
+
+// string returns the entry of the string table at the given index.
+func (p *protoProfile) string(idx int64) string {
+	if idx < 0 || idx >= int64(len(p.strings)) {
+		return ""
+	}
+
+	return p.strings[idx]
+}
+
+func (p *protoProfile) parse(data []byte) error {
+	p.locations = map[uint64][]protoLine{}
+	p.functions = map[uint64]protoFunction{}
+
+	r := protobufReader{data: data}
+	for r.next() {
+		switch r.tag {
+		case 1: // sample_type
+			var sampleType int64
+			message := r.message()
+			for message.next() {
+				if message.tag == 1 {
+					sampleType = int64(message.varint())
+				} else {
+					message.skip()
+				}
+			}
+
+			r.err = message.err
+			p.sampleTypes = append(p.sampleTypes, sampleType)
+
+		case 2: // sample
+			var sample protoSample
+			message := r.message()
+			for message.next() {
+				switch message.tag {
+				case 1:
+					sample.locationIds = message.uint64s(sample.locationIds)
+
+				case 2:
+					for _, value := range message.uint64s(nil) {
+						sample.values = append(sample.values, int64(value))
+					}
+
+				case 3:
+					var label protoLabel
+					labelMessage := message.message()
+					for labelMessage.next() {
+						switch labelMessage.tag {
+						case 1:
+							label.key = int64(labelMessage.varint())
+						case 2:
+							label.str = int64(labelMessage.varint())
+						default:
+							labelMessage.skip()
+						}
+					}
+
+					message.err = labelMessage.err
+					sample.labels = append(sample.labels, label)
+
+				default:
+					message.skip()
+				}
+			}
+
+			r.err = message.err
+			p.samples = append(p.samples, sample)
+
+		case 4: // location
+			var id uint64
+			var lines []protoLine
+
+			message := r.message()
+			for message.next() {
+				switch message.tag {
+				case 1:
+					id = message.varint()
+
+				case 4:
+					var line protoLine
+					lineMessage := message.message()
+					for lineMessage.next() {
+						switch lineMessage.tag {
+						case 1:
+							line.functionId = lineMessage.varint()
+						case 2:
+							line.line = int64(lineMessage.varint())
+						default:
+							lineMessage.skip()
+						}
+					}
+
+					message.err = lineMessage.err
+					lines = append(lines, line)
+
+				default:
+					message.skip()
+				}
+			}
+
+			r.err = message.err
+			p.locations[id] = lines
+
+		case 5: // function
+			var id uint64
+			var function protoFunction
+
+			message := r.message()
+			for message.next() {
+				switch message.tag {
+				case 1:
+					id = message.varint()
+				case 2:
+					function.name = int64(message.varint())
+				case 4:
+					function.filename = int64(message.varint())
+				default:
+					message.skip()
+				}
+			}
+
+			r.err = message.err
+			p.functions[id] = function
+
+		case 6: // string_table
+			p.strings = append(p.strings, string(r.bytes()))
+
+		case 9:
+			p.timeNanos = int64(r.varint())
+
+		case 10:
+			p.durationNanos = int64(r.varint())
+
+		case 12:
+			p.period = int64(r.varint())
+
+		default:
+			r.skip()
+		}
+	}
+
+	return r.err
+}
+
+var errTruncatedProtobuf = errors.New("truncated protobuf message")
+
+// protobufReader is a very small protocol buffer decoder that supports
+// just enough of the wire format to read profile.proto messages.
+type protobufReader struct {
+	data []byte
+	err  error
+
+	// tag and wire type of the current field
+	tag  int
+	wire int
+}
+
+// next advances to the next field. It returns false at the
+// end of the message or if an error occurred.
+func (r *protobufReader) next() bool {
+	if r.err != nil || len(r.data) == 0 {
+		return false
+	}
+
+	key := r.varint()
+	r.tag = int(key >> 3)
+	r.wire = int(key & 7)
+
+	return r.err == nil
+}
+
+func (r *protobufReader) varint() uint64 {
+	var x uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if len(r.data) == 0 {
+			r.err = errTruncatedProtobuf
+			return 0
+		}
+
+		b := r.data[0]
+		r.data = r.data[1:]
+
+		x |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return x
+		}
+	}
+
+	r.err = errors.New("invalid varint in protobuf message")
+	return 0
+}
+
+func (r *protobufReader) bytes() []byte {
+	if r.wire != 2 {
+		r.err = fmt.Errorf("expected length delimited field, got wire type %d", r.wire)
+		return nil
+	}
+
+	length := r.varint()
+	if r.err != nil {
+		return nil
+	}
+
+	if length > uint64(len(r.data)) {
+		r.err = errTruncatedProtobuf
+		return nil
+	}
+
+	data := r.data[:length]
+	r.data = r.data[length:]
+
+	return data
+}
+
+// message returns a reader for the embedded message of the current field.
+func (r *protobufReader) message() *protobufReader {
+	return &protobufReader{data: r.bytes(), err: r.err}
+}
+
+// uint64s appends the values of a repeated field, either
+// packed or as a single varint, to the given slice.
+func (r *protobufReader) uint64s(values []uint64) []uint64 {
+	if r.wire == 0 {
+		return append(values, r.varint())
+	}
+
+	packed := r.message()
+	for packed.err == nil && len(packed.data) > 0 {
+		values = append(values, packed.varint())
+	}
+
+	r.err = packed.err
+
+	return values
+}
+
+// skip skips the value of the current field.
+func (r *protobufReader) skip() {
+	switch r.wire {
+	case 0:
+		r.varint()
+
+	case 1:
+		r.fixed(8)
+
+	case 2:
+		r.bytes()
+
+	case 5:
+		r.fixed(4)
+
+	default:
+		r.err = fmt.Errorf("unsupported wire type %d", r.wire)
+	}
+}
+
+func (r *protobufReader) fixed(size int) {
+	if len(r.data) < size {
+		r.err = errTruncatedProtobuf
+		return
+	}
+
+	r.data = r.data[size:]
+}
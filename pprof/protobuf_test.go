@@ -0,0 +1,178 @@
+package pprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+)
+
+// busyLoop keeps the cpu busy for the given duration.
+func busyLoop(duration time.Duration) int {
+	var result int
+
+	end := time.Now().Add(duration)
+	for time.Now().Before(end) {
+		for idx := 0; idx < 1000; idx++ {
+			result += idx
+		}
+	}
+
+	return result
+}
+
+// recordProfile records a cpu profile using runtime/pprof while running a
+// busy loop labeled with test=busy.
+func recordProfile(t *testing.T) []byte {
+	var buffer bytes.Buffer
+	if err := pprof.StartCPUProfile(&buffer); err != nil {
+		t.Fatalf("start cpu profile: %s", err)
+	}
+
+	pprof.Do(context.Background(), pprof.Labels("test", "busy"), func(ctx context.Context) {
+		busyLoop(500 * time.Millisecond)
+	})
+
+	pprof.StopCPUProfile()
+
+	return buffer.Bytes()
+}
+
+func stackContains(profile *Profile, stack []MethodId, name string) bool {
+	for _, methodId := range stack {
+		if strings.HasSuffix(profile.Names[methodId], name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestAddProtobuf(t *testing.T) {
+	data := recordProfile(t)
+
+	profile := &Profile{}
+	if err := profile.addProtobuf(data); err != nil {
+		t.Fatalf("add profile: %s", err)
+	}
+
+	if len(profile.Samples) == 0 {
+		t.Fatal("expected samples")
+	}
+
+	var total, busy time.Duration
+	for _, sample := range profile.Samples {
+		if sample.Kind != SampleKindCPU {
+			t.Errorf("expected cpu sample, got %s", sample.Kind)
+		}
+
+		total += sample.Duration
+
+		if stackContains(profile, sample.Stack, "pprof.busyLoop") {
+			busy += sample.Duration
+
+			if sample.Labels["test"] != "busy" {
+				t.Errorf("expected label test=busy, got %v", sample.Labels)
+			}
+
+			// the stack is ordered from the root
+			if stackContains(profile, sample.Stack[:1], "pprof.busyLoop") {
+				t.Errorf("expected stack to start at the root")
+			}
+		}
+	}
+
+	if busy < 200*time.Millisecond || total > 2*time.Second {
+		t.Errorf("expected about 500ms in busy loop, got %s of %s", busy, total)
+	}
+}
+
+func TestAddProtobufTruncated(t *testing.T) {
+	data := recordProfile(t)
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decompress profile: %s", err)
+	}
+
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("decompress profile: %s", err)
+	}
+
+	var failed int
+	for length := 1; length < len(raw); length += 7 {
+		profile := &Profile{}
+		if err := profile.addProtobuf(raw[:length]); err != nil {
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		t.Error("expected truncated profiles to fail")
+	}
+
+	profile := &Profile{}
+	if err := profile.addProtobuf(data[:len(data)/2]); err == nil {
+		t.Error("expected truncated gzip data to fail")
+	}
+}
+
+func TestAddProtobufGarbage(t *testing.T) {
+	inputs := map[string][]byte{
+		"length exceeds message": {0x0a, 0xff, 0x01},
+		"unterminated varint":    {0x48, 0xff, 0xff},
+		"invalid wire type":      {0x0f, 0x00},
+		"invalid gzip":           {0x1f, 0x8b, 0x00, 0x01},
+		"overlong varint":        bytes.Repeat([]byte{0xff}, 12),
+	}
+
+	for name, input := range inputs {
+		profile := &Profile{}
+		if err := profile.addProtobuf(input); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestPprofCPUProfiler(t *testing.T) {
+	var cpuProfiler pprofCPUProfiler
+	if err := cpuProfiler.start(pprofSampleFrequencyHz); err != nil {
+		t.Fatalf("start: %s", err)
+	}
+
+	busyLoop(300 * time.Millisecond)
+
+	profile := &Profile{}
+	if eof, err := cpuProfiler.read(profile); eof || err != nil || len(profile.Samples) > 0 {
+		t.Fatalf("expected read to wait for the end of the window, got eof=%t, err=%v", eof, err)
+	}
+
+	if eof, err := cpuProfiler.flush(profile); eof || err != nil {
+		t.Fatalf("flush: eof=%t, err=%v", eof, err)
+	}
+
+	if len(profile.Samples) == 0 {
+		t.Fatal("expected samples after flush")
+	}
+
+	busyLoop(300 * time.Millisecond)
+	cpuProfiler.stop()
+
+	next := &Profile{}
+	if eof, err := cpuProfiler.read(next); !eof || err != nil {
+		t.Fatalf("expected eof after stop, got eof=%t, err=%v", eof, err)
+	}
+
+	if len(next.Samples) == 0 {
+		t.Fatal("expected remaining samples after stop")
+	}
+
+	if eof, _ := cpuProfiler.read(next); !eof {
+		t.Fatal("expected eof on further reads")
+	}
+}
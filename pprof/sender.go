@@ -1,31 +1,103 @@
 package pprof
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
 )
 
 var ErrQueueIsFull = errors.New("queue is full")
 
+var ErrCollectorClosed = errors.New("collector is closed")
+
 type Logger func(fmt string, args ...interface{})
 
 type Sender interface {
 	Send(p *Profile) error
 }
 
-type Collector struct {
-	sender     Sender
-	logger     Logger
-	profilesCh chan *Profile
-	closedCh   chan bool
+// EncodingTimer can be implemented by a Sender to report the time it spent
+// serializing and compressing profiles. This time is counted as overhead by
+// the adaptive sampling. The time spent waiting for the network is not, as
+// it does not use the cpu.
+type EncodingTimer interface {
+	// TakeEncodingTime returns the time spent encoding
+	// profiles since the previous call.
+	TakeEncodingTime() time.Duration
+}
+
+// RetryConfig configures how often and how fast the Collector
+// retries to send a profile after the Sender returned an error.
+type RetryConfig struct {
+	// The number of retries after the first failed attempt. A negative
+	// value disables retries. Defaults to 5.
+	MaxRetries int
+
+	// The backoff before the first retry. The backoff is doubled
+	// after each retry. Defaults to 500ms.
+	InitialBackoff time.Duration
+
+	// The maximum backoff between two retries. Defaults to 30s.
+	MaxBackoff time.Duration
 }
 
+type CollectorConfig struct {
+	Sender Sender
+	Logger Logger
+
+	Retry RetryConfig
+
+	// The maximum size of all pending profiles in bytes. If the buffer
+	// is full, the oldest profiles are dropped. Defaults to 8MB.
+	MaxBufferSize int
+}
+
+type Collector struct {
+	CollectorConfig
+
+	lock       sync.Mutex
+	queue      []*Profile
+	queueBytes int
+	closed     bool
+
+	// number of profiles that were dropped since the
+	// last successfully send profile.
+	dropped int
+
+	wakeupCh  chan struct{}
+	closingCh chan struct{}
+	closedCh  chan bool
+}
 
 func NewCollector(sender Sender, logger Logger) *Collector {
+	return NewCollectorWithConfig(CollectorConfig{Sender: sender, Logger: logger})
+}
+
+func NewCollectorWithConfig(config CollectorConfig) *Collector {
+	if config.Retry.MaxRetries == 0 {
+		config.Retry.MaxRetries = 5
+	}
+
+	if config.Retry.InitialBackoff == 0 {
+		config.Retry.InitialBackoff = 500 * time.Millisecond
+	}
+
+	if config.Retry.MaxBackoff == 0 {
+		config.Retry.MaxBackoff = 30 * time.Second
+	}
+
+	if config.MaxBufferSize == 0 {
+		config.MaxBufferSize = 8 * 1024 * 1024
+	}
+
 	collector := &Collector{
-		sender:     sender,
-		logger:     logger,
-		profilesCh: make(chan *Profile, 16),
-		closedCh:   make(chan bool),
+		CollectorConfig: config,
+		wakeupCh:        make(chan struct{}, 1),
+		closingCh:       make(chan struct{}),
+		closedCh:        make(chan bool),
 	}
 
 	go collector.run()
@@ -34,31 +106,90 @@ func NewCollector(sender Sender, logger Logger) *Collector {
 }
 
 // Close the collectors. This ensures, that all pending profiles are send out.
+// Failed profiles are not retried anymore once the collector is closing.
 func (c *Collector) Close() error {
-	close(c.profilesCh)
-	<-c.closedCh
-	return nil
+	return c.CloseContext(context.Background())
 }
 
+// CloseContext closes the collector like Close, but stops waiting for the
+// pending profiles once the context is done. Profiles that were not yet
+// send are dropped and the error of the context is returned.
+func (c *Collector) CloseContext(ctx context.Context) error {
+	c.lock.Lock()
+	alreadyClosed := c.closed
+	c.closed = true
+	c.lock.Unlock()
+
+	if !alreadyClosed {
+		close(c.closingCh)
+	}
+
+	select {
+	case <-c.closedCh:
+		return nil
+
+	case <-ctx.Done():
+		c.lock.Lock()
+		c.dropped += len(c.queue)
+		c.queue = nil
+		c.queueBytes = 0
+		c.lock.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// empty returns true if the profile contains nothing worth sending.
+func (p *Profile) empty() bool {
+	return len(p.Samples) == 0 && p.Goroutines == 0 &&
+		p.Metrics == nil && len(p.Spans) == 0 && p.LostSamples == 0
+}
+
+// Enqueue adds the profile to the queue of profiles to send. If the buffer is
+// full, the oldest profiles are dropped and ErrQueueIsFull is returned. The
+// profile itself is always enqueued. Profiles without any content are ignored.
 func (c *Collector) Enqueue(p *Profile) error {
-	if p == nil || len(p.Samples) == 0 {
+	if p == nil || p.empty() {
 		return nil
 	}
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return ErrCollectorClosed
+	}
+
+	c.queue = append(c.queue, p)
+	c.queueBytes += p.estimatedSize()
+
+	var err error
+
+	// drop the oldest profiles until the queue fits into the buffer
+	for c.queueBytes > c.MaxBufferSize && len(c.queue) > 1 {
+		c.queueBytes -= c.queue[0].estimatedSize()
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.dropped++
+
+		err = ErrQueueIsFull
+	}
+
+	// wakeup the sender if it is waiting
 	select {
-	case c.profilesCh <- p:
-		return nil
+	case c.wakeupCh <- struct{}{}:
 	default:
-		return ErrQueueIsFull
 	}
+
+	return err
 }
 
 func (c *Collector) run() {
 	defer close(c.closedCh)
 
 	for {
-		profile, ok := <-c.profilesCh
-		if ! ok {
+		profile, ok := c.next()
+		if !ok {
 			break
 		}
 
@@ -66,15 +197,115 @@ func (c *Collector) run() {
 	}
 }
 
+// next blocks until a profile is available. It returns false
+// once the collector is closed and all profiles are send.
+func (c *Collector) next() (*Profile, bool) {
+	for {
+		c.lock.Lock()
+
+		if len(c.queue) > 0 {
+			profile := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.queueBytes -= profile.estimatedSize()
+
+			c.lock.Unlock()
+			return profile, true
+		}
+
+		closed := c.closed
+		c.lock.Unlock()
+
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-c.wakeupCh:
+		case <-c.closingCh:
+		}
+	}
+}
+
+// send sends the profile, retrying with an exponential backoff if the sender
+// fails. If all retries fail, the profile is dropped.
 func (c *Collector) send(profile *Profile) {
+	backoff := c.Retry.InitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		c.lock.Lock()
+		profile.DroppedProfiles = c.dropped
+		c.lock.Unlock()
+
+		err := c.trySend(profile)
+
+		if err == nil {
+			// the receiver now knows about the dropped profiles
+			c.lock.Lock()
+			c.dropped -= profile.DroppedProfiles
+			c.lock.Unlock()
+			return
+		}
+
+		if attempt >= c.Retry.MaxRetries || !c.sleep(jitter(backoff)) {
+			c.Logger("sending profile failed, dropping profile: %s", err)
+
+			c.lock.Lock()
+			c.dropped++
+			c.lock.Unlock()
+			return
+		}
+
+		c.Logger("sending profile failed, will retry: %s", err)
+
+		backoff *= 2
+		if backoff > c.Retry.MaxBackoff {
+			backoff = c.Retry.MaxBackoff
+		}
+	}
+}
+
+// takeEncodingTime returns the time the sender spent encoding profiles
+// since the previous call, if the sender reports it.
+func (c *Collector) takeEncodingTime() time.Duration {
+	if timer, ok := c.Sender.(EncodingTimer); ok {
+		return timer.TakeEncodingTime()
+	}
+
+	return 0
+}
+
+func (c *Collector) trySend(profile *Profile) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			c.logger("sending profile failed: %v", r)
+			err = fmt.Errorf("sender panicked: %v", r)
 		}
 	}()
 
-	err := c.sender.Send(profile)
-	if err != nil {
-		c.logger("sending profile failed: %s", err)
+	return c.Sender.Send(profile)
+}
+
+// sleep waits for the given duration. It returns false, if
+// the collector was closed while waiting.
+func (c *Collector) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-c.closingCh:
+		return false
 	}
 }
+
+// jitter returns a random duration between half and the full duration.
+func jitter(duration time.Duration) time.Duration {
+	if duration <= 1 {
+		return duration
+	}
+
+	half := duration / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
@@ -0,0 +1,298 @@
+package sender
+
+import (
+	"encoding/binary"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"sort"
+	"strings"
+)
+
+// ContentTypeBinary is the content type of profiles in the binary format.
+const ContentTypeBinary = "application/x-alwaysprofile-v2"
+
+// magic bytes at the start of a binary profile. The version in the magic
+// must be increased with every change of the layout that older receivers
+// can not decode. Adding a new optional section is not such a change.
+var binaryMagic = []byte("APB2")
+
+// ids of the optional sections of a binary profile.
+const (
+	binarySectionMetrics = 1
+	binarySectionSpans   = 2
+	binarySectionLost    = 3
+	binarySectionDrift   = 4
+	binarySectionNames   = 5
+)
+
+// serializeAsBinary encodes the profile in a compact binary format. All
+// integers are varint encoded. Stacks, label sets and sample kinds are
+// deduplicated into tables that are referenced by index from the samples,
+// method names are already a string table. Sample timestamps are delta encoded.
+// The names, files and lines start at the given offset, the receiver
+// already knows the ones before.
+//
+// The format is:
+//
+//	magic "APB2"
+//	type, serviceName: string
+//	start: varint (unix nanos)
+//	instanceId: 16 bytes
+//	tags: count, (key, value string)*
+//	valueTypes, names, files: count, string*
+//	lines: count, varint*
+//	droppedProfiles, goroutines: uvarint
+//	kinds: count, string*
+//	labelSets: count, (count, (key, value string)*)*
+//	stacks: count, (count, uvarint*)*
+//	samples: count, (timestampDelta varint, duration varint, kind uvarint,
+//	                 stack uvarint, labelSet+1 uvarint, values: count, varint*)*
+//	sections: (id uvarint, length uvarint, bytes)*
+//
+// Strings are encoded as their length in bytes followed by the bytes. The
+// optional sections follow the samples until the end of the payload.
+// Readers skip sections they do not know. The sections are:
+//
+//	1 metrics: heapInUse, heapAlloc, heapObjects, numGC, pauseTotalNs,
+//	           goroutines, gomaxprocs: uvarint
+//	2 spans: count, (name, traceId, spanId: string, start varint,
+//	         duration varint)*
+//	3 lost samples: lostSamples uvarint
+//	4 clock drift: clockDriftNs varint
+//	5 names offset: the id of the first name, namesOffset uvarint
+func serializeAsBinary(prof *pprof.Profile, namesOffset int) []byte {
+	var w binaryWriter
+
+	w.buf = append(w.buf, binaryMagic...)
+
+	w.WriteString(prof.Type.String())
+	w.WriteString(prof.ServiceName)
+	w.WriteVarint(prof.Start.UnixNano())
+	w.buf = append(w.buf, prof.InstanceId[:]...)
+
+	w.WriteStringMap(prof.Tags)
+	w.WriteStrings(prof.ValueTypes)
+	w.WriteStrings(prof.Names[namesOffset:])
+
+	var files []string
+	var lines []int32
+	if len(prof.Files) > 0 {
+		files = prof.Files[namesOffset:]
+		lines = prof.Lines[namesOffset:]
+	}
+
+	w.WriteStrings(files)
+
+	w.WriteUvarint(uint64(len(lines)))
+	for _, line := range lines {
+		w.WriteVarint(int64(line))
+	}
+
+	w.WriteUvarint(uint64(prof.DroppedProfiles))
+	w.WriteUvarint(uint64(prof.Goroutines))
+
+	// build the tables referenced by the samples
+	var kinds []string
+	kindIndices := map[pprof.SampleKind]uint64{}
+
+	var labelSets []map[string]string
+	labelSetIndices := map[string]uint64{}
+
+	var stacks [][]pprof.MethodId
+	stackIndices := map[string]uint64{}
+
+	type sampleRefs struct{ kind, labelSet, stack uint64 }
+	refs := make([]sampleRefs, len(prof.Samples))
+
+	for idx, sample := range prof.Samples {
+		kindIdx, ok := kindIndices[sample.Kind]
+		if !ok {
+			kindIdx = uint64(len(kinds))
+			kindIndices[sample.Kind] = kindIdx
+			kinds = append(kinds, sample.Kind.String())
+		}
+
+		// zero means no labels
+		var labelSetIdx uint64
+		if len(sample.Labels) > 0 {
+			key := labelSetKey(sample.Labels)
+
+			labelSetIdx, ok = labelSetIndices[key]
+			if !ok {
+				labelSets = append(labelSets, sample.Labels)
+				labelSetIdx = uint64(len(labelSets))
+				labelSetIndices[key] = labelSetIdx
+			}
+		}
+
+		stackKey := stackKey(sample.Stack)
+		stackIdx, ok := stackIndices[stackKey]
+		if !ok {
+			stackIdx = uint64(len(stacks))
+			stackIndices[stackKey] = stackIdx
+			stacks = append(stacks, sample.Stack)
+		}
+
+		refs[idx] = sampleRefs{kindIdx, labelSetIdx, stackIdx}
+	}
+
+	w.WriteStrings(kinds)
+
+	w.WriteUvarint(uint64(len(labelSets)))
+	for _, labels := range labelSets {
+		w.WriteStringMap(labels)
+	}
+
+	w.WriteUvarint(uint64(len(stacks)))
+	for _, stack := range stacks {
+		w.WriteUvarint(uint64(len(stack)))
+		for _, methodId := range stack {
+			w.WriteUvarint(uint64(methodId))
+		}
+	}
+
+	w.WriteUvarint(uint64(len(prof.Samples)))
+
+	previousTimestamp := prof.Start.UnixNano()
+	for idx, sample := range prof.Samples {
+		w.WriteVarint(int64(sample.TimestampNs) - previousTimestamp)
+		previousTimestamp = int64(sample.TimestampNs)
+
+		w.WriteVarint(int64(sample.Duration))
+		w.WriteUvarint(refs[idx].kind)
+		w.WriteUvarint(refs[idx].stack)
+		w.WriteUvarint(refs[idx].labelSet)
+
+		w.WriteUvarint(uint64(len(sample.Values)))
+		for _, value := range sample.Values {
+			w.WriteVarint(value)
+		}
+	}
+
+	if metrics := prof.Metrics; metrics != nil {
+		var section binaryWriter
+		section.WriteUvarint(metrics.HeapInUse)
+		section.WriteUvarint(metrics.HeapAlloc)
+		section.WriteUvarint(metrics.HeapObjects)
+		section.WriteUvarint(uint64(metrics.NumGC))
+		section.WriteUvarint(uint64(metrics.PauseTotal))
+		section.WriteUvarint(uint64(metrics.Goroutines))
+		section.WriteUvarint(uint64(metrics.GOMAXPROCS))
+
+		w.WriteSection(binarySectionMetrics, section.buf)
+	}
+
+	if len(prof.Spans) > 0 {
+		var section binaryWriter
+		section.WriteUvarint(uint64(len(prof.Spans)))
+		for _, span := range prof.Spans {
+			section.WriteString(span.Name)
+			section.WriteString(span.TraceId)
+			section.WriteString(span.SpanId)
+			section.WriteVarint(span.Start.UnixNano())
+			section.WriteVarint(int64(span.Duration))
+		}
+
+		w.WriteSection(binarySectionSpans, section.buf)
+	}
+
+	if prof.LostSamples > 0 {
+		var section binaryWriter
+		section.WriteUvarint(uint64(prof.LostSamples))
+
+		w.WriteSection(binarySectionLost, section.buf)
+	}
+
+	if prof.ClockDrift != 0 {
+		var section binaryWriter
+		section.WriteVarint(int64(prof.ClockDrift))
+
+		w.WriteSection(binarySectionDrift, section.buf)
+	}
+
+	if namesOffset > 0 {
+		var section binaryWriter
+		section.WriteUvarint(uint64(namesOffset))
+
+		w.WriteSection(binarySectionNames, section.buf)
+	}
+
+	return w.buf
+}
+
+func stackKey(stack []pprof.MethodId) string {
+	var w binaryWriter
+	for _, methodId := range stack {
+		w.WriteUvarint(uint64(methodId))
+	}
+
+	return string(w.buf)
+}
+
+func labelSetKey(labels map[string]string) string {
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key)
+		b.WriteByte(0)
+		b.WriteString(labels[key])
+		b.WriteByte(0)
+	}
+
+	return b.String()
+}
+
+type binaryWriter struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) WriteUvarint(value uint64) {
+	n := binary.PutUvarint(w.scratch[:], value)
+	w.buf = append(w.buf, w.scratch[:n]...)
+}
+
+func (w *binaryWriter) WriteVarint(value int64) {
+	n := binary.PutVarint(w.scratch[:], value)
+	w.buf = append(w.buf, w.scratch[:n]...)
+}
+
+func (w *binaryWriter) WriteString(value string) {
+	w.WriteUvarint(uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *binaryWriter) WriteStrings(values []string) {
+	w.WriteUvarint(uint64(len(values)))
+	for _, value := range values {
+		w.WriteString(value)
+	}
+}
+
+func (w *binaryWriter) WriteSection(id uint64, payload []byte) {
+	w.WriteUvarint(id)
+	w.WriteUvarint(uint64(len(payload)))
+	w.buf = append(w.buf, payload...)
+}
+
+// WriteStringMap writes the entries of the map sorted by key,
+// so that the same map is always encoded to the same bytes.
+func (w *binaryWriter) WriteStringMap(values map[string]string) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	w.WriteUvarint(uint64(len(keys)))
+	for _, key := range keys {
+		w.WriteString(key)
+		w.WriteString(values[key])
+	}
+}
@@ -0,0 +1,130 @@
+package sender
+
+import (
+	"bytes"
+	"flag"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the ingest module decodes the same file, which
+// checks that both sides agree on the format.
+var binaryTestdata = filepath.Join("testdata", "profile.bin")
+
+var update = flag.Bool("update", false, "update the encoded profile in testdata")
+
+// testProfile returns a profile that uses all parts of the binary format.
+func testProfile() *pprof.Profile {
+	start := time.Unix(1500000000, 0)
+
+	return &pprof.Profile{
+		Type:        pprof.ProfileTypeCPU,
+		Start:       start,
+		ServiceName: "service",
+		InstanceId:  uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef"),
+		Tags:        map[string]string{"region": "eu", "version": "1.0"},
+
+		Names: []string{"main.main", "main.work", "main.wait"},
+		Files: []string{"main.go", "main.go", "wait.go"},
+		Lines: []int32{10, 20, 30},
+
+		Samples: []pprof.Sample{
+			{
+				TimestampNs: uint64(start.Add(10 * time.Millisecond).UnixNano()),
+				Duration:    10 * time.Millisecond,
+				Stack:       []pprof.MethodId{0, 1},
+				Labels:      map[string]string{"span": "request", "span_id": "42"},
+				Kind:        pprof.SampleKindCPU,
+			},
+			{
+				TimestampNs: uint64(start.Add(5 * time.Millisecond).UnixNano()),
+				Duration:    20 * time.Millisecond,
+				Stack:       []pprof.MethodId{0, 2},
+				Kind:        pprof.SampleKindOffCPU,
+			},
+			{
+				TimestampNs: uint64(start.Add(30 * time.Millisecond).UnixNano()),
+				Duration:    10 * time.Millisecond,
+				Stack:       []pprof.MethodId{0, 1},
+				Labels:      map[string]string{"span": "request", "span_id": "42"},
+				Kind:        pprof.SampleKindCPU,
+			},
+		},
+
+		DroppedProfiles: 2,
+		LostSamples:     3,
+		ClockDrift:      -4 * time.Millisecond,
+
+		Metrics: &pprof.RuntimeMetrics{
+			HeapInUse:   1000,
+			HeapAlloc:   800,
+			HeapObjects: 50,
+			NumGC:       7,
+			PauseTotal:  time.Millisecond,
+			Goroutines:  12,
+			GOMAXPROCS:  4,
+		},
+
+		Spans: []pprof.SpanRecord{
+			{
+				Name:     "request",
+				TraceId:  "trace",
+				SpanId:   "42",
+				Start:    start.Add(time.Millisecond),
+				Duration: 40 * time.Millisecond,
+			},
+		},
+	}
+}
+
+func TestSerializeAsBinary(t *testing.T) {
+	// the first name is already known by the receiver
+	payload := serializeAsBinary(testProfile(), 1)
+
+	if !bytes.Equal(serializeAsBinary(testProfile(), 1), payload) {
+		t.Fatal("expected the same profile to be encoded to the same bytes")
+	}
+
+	if *update {
+		if err := ioutil.WriteFile(binaryTestdata, payload, 0644); err != nil {
+			t.Fatalf("write testdata: %s", err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(binaryTestdata)
+	if err != nil {
+		t.Fatalf("read testdata: %s", err)
+	}
+
+	if !bytes.Equal(expected, payload) {
+		t.Errorf("encoded profile differs from %s, run the test with -update if the format changed", binaryTestdata)
+	}
+}
+
+func TestSerializeAsBinaryWithoutOptionalParts(t *testing.T) {
+	profile := &pprof.Profile{
+		Type:  pprof.ProfileTypeGoroutine,
+		Start: time.Unix(1500000000, 0),
+		Names: []string{"main.main"},
+		Samples: []pprof.Sample{
+			{Stack: []pprof.MethodId{0}, Values: []int64{5}},
+		},
+		ValueTypes: []string{"goroutines"},
+		Goroutines: 5,
+	}
+
+	full := serializeAsBinary(testProfile(), 1)
+	payload := serializeAsBinary(profile, 0)
+
+	if !bytes.HasPrefix(payload, binaryMagic) {
+		t.Fatal("expected payload to start with the magic bytes")
+	}
+
+	if len(payload) >= len(full) {
+		t.Errorf("expected profile without sections to be smaller, got %d bytes", len(payload))
+	}
+}
@@ -0,0 +1,368 @@
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const fileSuffix = ".pb.gz"
+
+type Config struct {
+	// The directory to write the profiles to. It is created if it does not exist.
+	Directory string
+
+	// The maximum number of profile files to keep in the directory. If
+	// the limit is reached, the oldest files are deleted. Defaults to 100.
+	MaxFiles int
+}
+
+type sender struct {
+	Config
+
+	lock sync.Mutex
+}
+
+// New creates a sender that writes each profile as a gzip compressed
+// profile.proto file into the directory. Those files can be opened
+// using 'go tool pprof' and other standard tools.
+func New(config Config) (pprof.Sender, error) {
+	if config.Directory == "" {
+		return nil, errors.New("no directory configured")
+	}
+
+	if config.MaxFiles == 0 {
+		config.MaxFiles = 100
+	}
+
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("create profile directory: %s", err)
+	}
+
+	return &sender{Config: config}, nil
+}
+
+func (s *sender) Send(p *pprof.Profile) error {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(Encode(p)); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the timestamp first, so the file names sort by time
+	name := fmt.Sprintf("%s-%s-%s-%s%s",
+		p.Start.UTC().Format("20060102T150405.000"),
+		sanitize(p.ServiceName), p.InstanceId, p.Type, fileSuffix)
+
+	path := filepath.Join(s.Directory, name)
+
+	// write to a temporary file first, so tools never see partial files
+	if err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return fmt.Errorf("write profile file: %s", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return fmt.Errorf("rename profile file: %s", err)
+	}
+
+	return s.rotate()
+}
+
+// rotate deletes the oldest profiles until at most MaxFiles are left.
+func (s *sender) rotate() error {
+	entries, err := ioutil.ReadDir(s.Directory)
+	if err != nil {
+		return fmt.Errorf("read profile directory: %s", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), fileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	for len(names) > s.MaxFiles {
+		if err := os.Remove(filepath.Join(s.Directory, names[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("delete old profile file: %s", err)
+		}
+
+		names = names[1:]
+	}
+
+	return nil
+}
+
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+
+		return r
+	}, name)
+}
+
+// Encode encodes the profile in the (uncompressed) profile.proto format.
+func Encode(p *pprof.Profile) []byte {
+	var w protobufWriter
+
+	table := newStringTable()
+
+	// message Profile fields
+	const (
+		tagProfileSampleType    = 1
+		tagProfileSample        = 2
+		tagProfileLocation      = 4
+		tagProfileFunction      = 5
+		tagProfileStringTable   = 6
+		tagProfileTimeNanos     = 9
+		tagProfileDurationNanos = 10
+		tagProfilePeriodType    = 11
+		tagProfilePeriod        = 12
+		tagProfileComment       = 13
+	)
+
+	// message ValueType fields
+	const (
+		tagValueTypeType = 1
+		tagValueTypeUnit = 2
+	)
+
+	// message Sample fields
+	const (
+		tagSampleLocation = 1
+		tagSampleValue    = 2
+		tagSampleLabel    = 3
+	)
+
+	// message Label fields
+	const (
+		tagLabelKey = 1
+		tagLabelStr = 2
+	)
+
+	// message Location fields
+	const (
+		tagLocationId   = 1
+		tagLocationLine = 4
+	)
+
+	// message Line fields
+	const (
+		tagLineFunctionId = 1
+		tagLineLine       = 2
+	)
+
+	// message Function fields
+	const (
+		tagFunctionId         = 1
+		tagFunctionName       = 2
+		tagFunctionSystemName = 3
+		tagFunctionFilename   = 4
+	)
+
+	valueType := func(tag int, typ, unit string) {
+		w.startMessage()
+		w.int64(tagValueTypeType, table.index(typ))
+		w.int64(tagValueTypeUnit, table.index(unit))
+		w.endMessage(tag)
+	}
+
+	cpuProfile := p.Type == pprof.ProfileTypeCPU
+
+	if cpuProfile {
+		valueType(tagProfileSampleType, "samples", "count")
+		valueType(tagProfileSampleType, "cpu", "nanoseconds")
+	} else {
+		for _, typ := range p.ValueTypes {
+			valueType(tagProfileSampleType, typ, unitOf(typ))
+		}
+	}
+
+	var lastTimestamp uint64
+
+	for _, sample := range p.Samples {
+		if sample.TimestampNs > lastTimestamp {
+			lastTimestamp = sample.TimestampNs
+		}
+
+		w.startMessage()
+
+		// locations are ordered leaf first in profile.proto, each
+		// method is written as a location with the id methodId+1.
+		locations := make([]uint64, len(sample.Stack))
+		for idx, methodId := range sample.Stack {
+			locations[len(locations)-1-idx] = uint64(methodId) + 1
+		}
+
+		w.uint64s(tagSampleLocation, locations)
+
+		if cpuProfile {
+			w.int64s(tagSampleValue, []int64{sampleCount(p, sample), int64(sample.Duration)})
+		} else {
+			w.int64s(tagSampleValue, sample.Values)
+		}
+
+		labels := func(key, value string) {
+			w.startMessage()
+			w.int64(tagLabelKey, table.index(key))
+			w.int64(tagLabelStr, table.index(value))
+			w.endMessage(tagSampleLabel)
+		}
+
+		if cpuProfile && sample.Kind != pprof.SampleKindCPU {
+			labels("kind", sample.Kind.String())
+		}
+
+		for _, key := range sortedKeys(sample.Labels) {
+			labels(key, sample.Labels[key])
+		}
+
+		w.endMessage(tagProfileSample)
+	}
+
+	// with line information, multiple locations share the same function.
+	type functionKey struct{ name, file string }
+	functionIds := map[functionKey]uint64{}
+
+	for idx, name := range p.Names {
+		var file string
+		var line int64
+		if idx < len(p.Files) && idx < len(p.Lines) {
+			file = p.Files[idx]
+			line = int64(p.Lines[idx])
+		}
+
+		key := functionKey{name, file}
+
+		functionId, ok := functionIds[key]
+		if !ok {
+			functionId = uint64(len(functionIds)) + 1
+			functionIds[key] = functionId
+
+			w.startMessage()
+			w.uint64(tagFunctionId, functionId)
+			w.int64(tagFunctionName, table.index(name))
+			w.int64(tagFunctionSystemName, table.index(name))
+			w.int64Opt(tagFunctionFilename, table.index(file))
+			w.endMessage(tagProfileFunction)
+		}
+
+		w.startMessage()
+		w.uint64(tagLocationId, uint64(idx)+1)
+		w.startMessage()
+		w.uint64(tagLineFunctionId, functionId)
+		w.int64Opt(tagLineLine, line)
+		w.endMessage(tagLocationLine)
+		w.endMessage(tagProfileLocation)
+	}
+
+	w.int64(tagProfileTimeNanos, p.Start.UnixNano())
+	if lastTimestamp > uint64(p.Start.UnixNano()) {
+		w.int64(tagProfileDurationNanos, int64(lastTimestamp)-p.Start.UnixNano())
+	}
+
+	if cpuProfile {
+		valueType(tagProfilePeriodType, "cpu", "nanoseconds")
+		w.int64Opt(tagProfilePeriod, int64(p.Period))
+	}
+
+	// add service name, instance id and tags as comments
+	w.int64(tagProfileComment, table.index("service="+p.ServiceName))
+	w.int64(tagProfileComment, table.index("instance="+p.InstanceId.String()))
+	for _, key := range sortedKeys(p.Tags) {
+		w.int64(tagProfileComment, table.index(key+"="+p.Tags[key]))
+	}
+
+	// the string table must be written last, after all strings are known.
+	for _, value := range table.values {
+		w.string(tagProfileStringTable, value)
+	}
+
+	return w.data
+}
+
+// sampleCount returns the number of samples taken by the runtime that a cpu
+// sample stands for. Samples of the fallback profiler are already merged.
+func sampleCount(p *pprof.Profile, sample pprof.Sample) int64 {
+	if p.Period <= 0 {
+		return 1
+	}
+
+	count := int64((sample.Duration + p.Period/2) / p.Period)
+	if count < 1 {
+		return 1
+	}
+
+	return count
+}
+
+// unitOf guesses the unit of a value type by its name.
+func unitOf(valueType string) string {
+	switch {
+	case strings.HasSuffix(valueType, "_bytes"):
+		return "bytes"
+
+	case valueType == "delay":
+		return "nanoseconds"
+
+	default:
+		return "count"
+	}
+}
+
+type stringTable struct {
+	values  []string
+	indices map[string]int64
+}
+
+func newStringTable() *stringTable {
+	// the first entry of the string table must be the empty string
+	return &stringTable{
+		values:  []string{""},
+		indices: map[string]int64{"": 0},
+	}
+}
+
+func (t *stringTable) index(value string) int64 {
+	if idx, ok := t.indices[value]; ok {
+		return idx
+	}
+
+	idx := int64(len(t.values))
+	t.values = append(t.values, value)
+	t.indices[value] = idx
+
+	return idx
+}
+
+func sortedKeys(values map[string]string) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+package file
+
+// protobufWriter is a very small protocol buffer encoder that supports
+// just enough of the wire format to write profile.proto messages.
+type protobufWriter struct {
+	data []byte
+
+	// start offsets of the currently open messages
+	nested []int
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (w *protobufWriter) varint(x uint64) {
+	for x >= 128 {
+		w.data = append(w.data, byte(x)|0x80)
+		x >>= 7
+	}
+
+	w.data = append(w.data, byte(x))
+}
+
+func (w *protobufWriter) length(tag int, length int) {
+	w.varint(uint64(tag)<<3 | wireBytes)
+	w.varint(uint64(length))
+}
+
+func (w *protobufWriter) uint64(tag int, x uint64) {
+	// append varint to w.data
+	w.varint(uint64(tag)<<3 | wireVarint)
+	w.varint(x)
+}
+
+func (w *protobufWriter) int64(tag int, x int64) {
+	w.uint64(tag, uint64(x))
+}
+
+func (w *protobufWriter) int64Opt(tag int, x int64) {
+	if x == 0 {
+		return
+	}
+
+	w.int64(tag, x)
+}
+
+// uint64s writes the values as a packed repeated field.
+func (w *protobufWriter) uint64s(tag int, x []uint64) {
+	if len(x) == 0 {
+		return
+	}
+
+	var packed protobufWriter
+	for _, u := range x {
+		packed.varint(u)
+	}
+
+	w.length(tag, len(packed.data))
+	w.data = append(w.data, packed.data...)
+}
+
+// int64s writes the values as a packed repeated field.
+func (w *protobufWriter) int64s(tag int, x []int64) {
+	if len(x) == 0 {
+		return
+	}
+
+	var packed protobufWriter
+	for _, u := range x {
+		packed.varint(uint64(u))
+	}
+
+	w.length(tag, len(packed.data))
+	w.data = append(w.data, packed.data...)
+}
+
+func (w *protobufWriter) string(tag int, x string) {
+	w.length(tag, len(x))
+	w.data = append(w.data, x...)
+}
+
+// startMessage begins a nested message. The message must be
+// closed using endMessage with the same tag.
+func (w *protobufWriter) startMessage() {
+	w.nested = append(w.nested, len(w.data))
+}
+
+// endMessage closes the most recent nested message. As the length
+// of the message is only known now, the content is moved to make
+// space for tag and length.
+func (w *protobufWriter) endMessage(tag int) {
+	start := w.nested[len(w.nested)-1]
+	w.nested = w.nested[:len(w.nested)-1]
+
+	content := append([]byte(nil), w.data[start:]...)
+	w.data = w.data[:start]
+
+	w.length(tag, len(content))
+	w.data = append(w.data, content...)
+}
@@ -0,0 +1,178 @@
+package folded
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// The writer to write the folded stacks to. If nil, the
+	// stacks are written to the file at Path.
+	Writer io.Writer
+
+	// Path of the file to append the folded stacks to.
+	Path string
+
+	// The maximum size of the file in bytes. If the file gets larger, it is
+	// rotated by renaming it to Path.1, Path.2, ... and a new file is started.
+	// Zero disables rotation.
+	MaxSize int64
+
+	// Number of rotated files to keep. Defaults to 5.
+	MaxFiles int
+
+	// The unit of the durations of cpu samples. Defaults to nanoseconds.
+	DurationUnit time.Duration
+}
+
+type sender struct {
+	Config
+
+	lock sync.Mutex
+
+	// the currently open file, if writing to Path
+	file     *os.File
+	fileSize int64
+}
+
+// New creates a sender that writes profiles in the folded stack format used by
+// Brendan Gregg's flame graph tools. Each line contains the frames of a stack,
+// root first and separated by semicolons, followed by the summed up duration of
+// all samples of that stack in the window. The values of the other profile
+// types and sample kinds have different units and can not be mixed into the
+// same file, so only the cpu samples of cpu profiles are written.
+func New(config Config) (pprof.Sender, error) {
+	if config.Writer == nil && config.Path == "" {
+		return nil, errors.New("neither writer nor path configured")
+	}
+
+	if config.MaxFiles == 0 {
+		config.MaxFiles = 5
+	}
+
+	if config.DurationUnit == 0 {
+		config.DurationUnit = time.Nanosecond
+	}
+
+	return &sender{Config: config}, nil
+}
+
+func (s *sender) Send(p *pprof.Profile) error {
+	content := Fold(p, s.DurationUnit)
+	if len(content) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Writer != nil {
+		_, err := s.Writer.Write(content)
+		return err
+	}
+
+	return s.writeToFile(content)
+}
+
+func (s *sender) writeToFile(content []byte) error {
+	if s.file != nil && s.MaxSize > 0 && s.fileSize+int64(len(content)) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if s.file == nil {
+		file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("open folded stack file: %s", err)
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return fmt.Errorf("stat folded stack file: %s", err)
+		}
+
+		s.file = file
+		s.fileSize = stat.Size()
+	}
+
+	n, err := s.file.Write(content)
+	s.fileSize += int64(n)
+
+	return err
+}
+
+// rotate closes the current file and shifts all rotated files by one.
+func (s *sender) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("close folded stack file: %s", err)
+	}
+
+	s.file = nil
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", s.Path, s.MaxFiles))
+
+	for idx := s.MaxFiles - 1; idx >= 1; idx-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", s.Path, idx), fmt.Sprintf("%s.%d", s.Path, idx+1))
+	}
+
+	if err := os.Rename(s.Path, s.Path+".1"); err != nil {
+		return fmt.Errorf("rotate folded stack file: %s", err)
+	}
+
+	return nil
+}
+
+// Fold converts the cpu samples of a cpu profile into the folded stack
+// format. Samples with the same stack are merged. The durations are given
+// in multiples of unit. Fold returns nil for all other profiles.
+func Fold(p *pprof.Profile, unit time.Duration) []byte {
+	if p.Type != pprof.ProfileTypeCPU {
+		return nil
+	}
+
+	values := map[string]int64{}
+
+	var line strings.Builder
+	for _, sample := range p.Samples {
+		if sample.Kind != pprof.SampleKindCPU {
+			continue
+		}
+
+		line.Reset()
+
+		for idx, methodId := range sample.Stack {
+			if idx > 0 {
+				line.WriteByte(';')
+			}
+
+			line.WriteString(p.Names[methodId])
+		}
+
+		values[line.String()] += int64(sample.Duration)
+	}
+
+	// sort the stacks to get a stable output
+	stacks := make([]string, 0, len(values))
+	for stack := range values {
+		stacks = append(stacks, stack)
+	}
+
+	sort.Strings(stacks)
+
+	var buf bytes.Buffer
+	for _, stack := range stacks {
+		_, _ = fmt.Fprintf(&buf, "%s %d\n", stack, values[stack]/int64(unit))
+	}
+
+	return buf.Bytes()
+}
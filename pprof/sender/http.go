@@ -2,25 +2,93 @@ package sender
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/flachnetz/alwaysprofile/pprof"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 )
 
+// Format is the wire format used to send profiles.
+type Format string
+
+const (
+	FormatJSON   Format = "json"
+	FormatBinary Format = "binary"
+)
+
+// Compression is the content encoding used to compress the request body.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
 type Config struct {
 	Client  *http.Client
 	BaseURL *url.URL
 	Timeout time.Duration
+
+	// The format to send profiles in. The binary format is much smaller
+	// than json, especially for high sample frequencies. Defaults to json.
+	Format Format
+
+	// The compression of the request body. Defaults to gzip.
+	Compression Compression
 }
 
 type sender struct {
+	// time spent serializing and compressing profiles in nanoseconds. Only
+	// accessed atomically, and the first field to keep it 64 bit aligned
+	// on 32 bit platforms.
+	encodingTime int64
+
 	Config
+
+	// only set for zstd compression. The encoder
+	// can be used concurrently with EncodeAll.
+	zstdEncoder *zstd.Encoder
+
+	// the number of method names of the instance that the receiver
+	// acknowledged. The ids of the methods are stable, so only the
+	// names after those need to be send.
+	namesLock     sync.Mutex
+	namesInstance uuid.UUID
+	knownNames    int
+}
+
+// StatusError is returned if the receiver responds with a status other than 2xx.
+type StatusError struct {
+	StatusCode int
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("expected 2xx response, got %d", err.StatusCode)
+}
+
+// Permanent returns true if the receiver rejected the profile, so
+// that sending the same profile again would fail too.
+func (err *StatusError) Permanent() bool {
+	switch err.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+
+	default:
+		return err.StatusCode/100 == 4
+	}
 }
 
 func New(config Config) pprof.Sender {
@@ -28,19 +96,102 @@ func New(config Config) pprof.Sender {
 		config.Client = http.DefaultClient
 	}
 
-	return &sender{Config: config}
+	if config.Format == "" {
+		config.Format = FormatJSON
+	}
+
+	if config.Compression == "" {
+		config.Compression = CompressionGzip
+	}
+
+	s := &sender{Config: config}
+
+	if config.Compression == CompressionZstd {
+		// creating an encoder without options never fails
+		s.zstdEncoder, _ = zstd.NewWriter(nil)
+	}
+
+	return s
 }
 
 func (sender *sender) Send(p *pprof.Profile) error {
-	payload := serializeAsJson(p)
+	namesOffset := sender.acknowledgedNames(p)
 
-	req, err := http.NewRequest("POST", sender.BaseURL.String(), bytes.NewReader(payload))
+	knownNames, err := sender.send(p, namesOffset)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
+	if knownNames < namesOffset {
+		// the receiver rejected the profile, as it does not know the
+		// names we skipped, e.g. because its data was reset.
+		knownNames, err = sender.send(p, knownNames)
+		if err != nil {
+			return err
+		}
+	}
+
+	sender.acknowledgeNames(p, knownNames)
+
+	return nil
+}
+
+// acknowledgedNames returns the number of names of the
+// profile that the receiver already knows.
+func (sender *sender) acknowledgedNames(p *pprof.Profile) int {
+	sender.namesLock.Lock()
+	defer sender.namesLock.Unlock()
+
+	if sender.namesInstance != p.InstanceId {
+		return 0
+	}
+
+	if sender.knownNames > len(p.Names) {
+		return len(p.Names)
+	}
+
+	return sender.knownNames
+}
+
+// acknowledgeNames records the number of names the receiver knows
+// after it received the profile. Profiles of a new instance, e.g. after
+// a restart of the profiler, start over.
+func (sender *sender) acknowledgeNames(p *pprof.Profile, knownNames int) {
+	sender.namesLock.Lock()
+	defer sender.namesLock.Unlock()
+
+	if knownNames > len(p.Names) {
+		knownNames = len(p.Names)
+	}
+
+	if sender.namesInstance != p.InstanceId || knownNames > sender.knownNames {
+		sender.namesInstance = p.InstanceId
+		sender.knownNames = knownNames
+	}
+}
+
+// send sends the profile without the names before namesOffset. It returns
+// the number of names the receiver knows. A receiver that does not know the
+// names before namesOffset rejects the profile and returns a smaller number.
+func (sender *sender) send(p *pprof.Profile, namesOffset int) (int, error) {
+	startTime := time.Now()
+
+	var payload []byte
+	var contentType string
+
+	switch sender.Format {
+	case FormatBinary:
+		payload, contentType = serializeAsBinary(p, namesOffset), ContentTypeBinary
+	default:
+		payload, contentType = serializeAsJson(p, namesOffset), "application/json"
+	}
+
+	payload, err := sender.compress(payload)
+	atomic.AddInt64(&sender.encodingTime, int64(time.Since(startTime)))
+
+	if err != nil {
+		return 0, err
+	}
 
 	ctx := context.Background()
 	if sender.Timeout > 0 {
@@ -49,26 +200,85 @@ func (sender *sender) Send(p *pprof.Profile) error {
 		defer cancel()
 	}
 
+	req, err := http.NewRequest("POST", sender.BaseURL.String(), bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", contentType)
+	if sender.Compression != CompressionNone {
+		req.Header.Set("Content-Encoding", string(sender.Compression))
+	}
+
 	resp, err := sender.Client.Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// clear the response
-	defer func() { _ = resp.Body.Close() }()
+	// clear the response, so the connection can be reused
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
 
 	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("expected 2xx response, got %d", resp.StatusCode)
+		return 0, &StatusError{StatusCode: resp.StatusCode}
 	}
 
-	return nil
+	var body struct {
+		KnownNames int `json:"knownNames"`
+	}
+
+	// older receivers do not acknowledge any names
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, nil
+	}
+
+	return body.KnownNames, nil
 }
 
-func serializeAsJson(prof *pprof.Profile) []byte {
+func (sender *sender) TakeEncodingTime() time.Duration {
+	return time.Duration(atomic.SwapInt64(&sender.encodingTime, 0))
+}
+
+// compress compresses the payload using the configured compression.
+func (sender *sender) compress(payload []byte) ([]byte, error) {
+	switch sender.Compression {
+	case CompressionNone:
+		return payload, nil
+
+	case CompressionGzip:
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+
+	case CompressionZstd:
+		return sender.zstdEncoder.EncodeAll(payload, nil), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", sender.Compression)
+	}
+}
+
+func serializeAsJson(prof *pprof.Profile, namesOffset int) []byte {
 	var w jsonWriter
 
 	w.BeginObject()
 	{
+		w.WriteField("type")
+		w.WriteString(prof.Type.String())
+
 		w.WriteField("start")
 		w.WriteInterface(prof.Start)
 
@@ -86,13 +296,117 @@ func serializeAsJson(prof *pprof.Profile) []byte {
 		}
 		w.EndObject()
 
+		if len(prof.ValueTypes) > 0 {
+			w.WriteField("valueTypes")
+			w.BeginArray()
+			for _, valueType := range prof.ValueTypes {
+				w.WriteString(valueType)
+			}
+			w.EndArray()
+		}
+
+		if prof.DroppedProfiles > 0 {
+			w.WriteField("droppedProfiles")
+			w.WriteInt64(int64(prof.DroppedProfiles))
+		}
+
+		if prof.LostSamples > 0 {
+			w.WriteField("lostSamples")
+			w.WriteInt64(int64(prof.LostSamples))
+		}
+
+		if prof.ClockDrift != 0 {
+			w.WriteField("clockDriftNs")
+			w.WriteInt64(int64(prof.ClockDrift))
+		}
+
+		if prof.Type == pprof.ProfileTypeGoroutine {
+			w.WriteField("goroutines")
+			w.WriteInt64(int64(prof.Goroutines))
+		}
+
+		if metrics := prof.Metrics; metrics != nil {
+			w.WriteField("metrics")
+			w.BeginObject()
+			{
+				w.WriteField("heapInUse")
+				w.WriteInt64(int64(metrics.HeapInUse))
+
+				w.WriteField("heapAlloc")
+				w.WriteInt64(int64(metrics.HeapAlloc))
+
+				w.WriteField("heapObjects")
+				w.WriteInt64(int64(metrics.HeapObjects))
+
+				w.WriteField("numGC")
+				w.WriteInt64(int64(metrics.NumGC))
+
+				w.WriteField("pauseTotalNs")
+				w.WriteInt64(int64(metrics.PauseTotal))
+
+				w.WriteField("goroutines")
+				w.WriteInt64(int64(metrics.Goroutines))
+
+				w.WriteField("gomaxprocs")
+				w.WriteInt64(int64(metrics.GOMAXPROCS))
+			}
+			w.EndObject()
+		}
+
+		if len(prof.Spans) > 0 {
+			w.WriteField("spans")
+			w.BeginArray()
+			for _, span := range prof.Spans {
+				w.BeginObject()
+				{
+					w.WriteField("name")
+					w.WriteString(span.Name)
+
+					w.WriteField("traceId")
+					w.WriteString(span.TraceId)
+
+					w.WriteField("spanId")
+					w.WriteString(span.SpanId)
+
+					w.WriteField("startNs")
+					w.WriteInt64(span.Start.UnixNano())
+
+					w.WriteField("durationNs")
+					w.WriteInt64(int64(span.Duration))
+				}
+				w.EndObject()
+			}
+			w.EndArray()
+		}
+
+		if namesOffset > 0 {
+			w.WriteField("namesOffset")
+			w.WriteInt64(int64(namesOffset))
+		}
+
 		w.WriteField("names")
 		w.BeginArray()
-		for _, name := range prof.Names {
+		for _, name := range prof.Names[namesOffset:] {
 			w.WriteString(name)
 		}
 		w.EndArray()
 
+		if len(prof.Files) > 0 {
+			w.WriteField("files")
+			w.BeginArray()
+			for _, file := range prof.Files[namesOffset:] {
+				w.WriteString(file)
+			}
+			w.EndArray()
+
+			w.WriteField("lines")
+			w.BeginArray()
+			for _, line := range prof.Lines[namesOffset:] {
+				w.WriteInt32(line)
+			}
+			w.EndArray()
+		}
+
 		w.WriteField("samples")
 		w.BeginArray()
 		{
@@ -105,6 +419,9 @@ func serializeAsJson(prof *pprof.Profile) []byte {
 					w.WriteField("durationNs")
 					w.WriteInt64(int64(sample.Duration))
 
+					w.WriteField("kind")
+					w.WriteString(sample.Kind.String())
+
 					w.WriteField("stack")
 					w.BeginArray()
 					for _, loc := range sample.Stack {
@@ -112,6 +429,25 @@ func serializeAsJson(prof *pprof.Profile) []byte {
 					}
 
 					w.EndArray()
+
+					if len(sample.Values) > 0 {
+						w.WriteField("values")
+						w.BeginArray()
+						for _, value := range sample.Values {
+							w.WriteInt64(value)
+						}
+						w.EndArray()
+					}
+
+					if len(sample.Labels) > 0 {
+						w.WriteField("labels")
+						w.BeginObject()
+						for key, value := range sample.Labels {
+							w.WriteField(key)
+							w.WriteString(value)
+						}
+						w.EndObject()
+					}
 				}
 				w.EndObject()
 			}
@@ -0,0 +1,268 @@
+package multi
+
+import (
+	"errors"
+	"fmt"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrAllDestinationsFull = errors.New("queues of all destinations are full")
+
+var ErrClosed = errors.New("sender is closed")
+
+type Destination struct {
+	// a name to identify the destination in logs and statistics.
+	Name string
+
+	Sender pprof.Sender
+
+	// The maximum time to wait for the sender to send a profile. After
+	// the timeout the call is abandoned. Until the abandoned call returns,
+	// the profiles for this destination are dropped, so there is at most
+	// one pending call per destination. Defaults to 10s.
+	Timeout time.Duration
+
+	// The number of profiles that can be queued for this destination.
+	// If the queue is full, new profiles are dropped for this
+	// destination. Defaults to 16.
+	QueueSize int
+}
+
+type Config struct {
+	Destinations []Destination
+	Logger       pprof.Logger
+}
+
+// Stats contains the counters of a destination.
+type Stats struct {
+	Name string
+
+	// number of profiles that were send successfully.
+	Sent uint64
+
+	// number of profiles the sender returned an error for.
+	Failed uint64
+
+	// number of profiles that were not send within the timeout.
+	TimedOut uint64
+
+	// number of profiles that were dropped because the queue was full
+	// or an abandoned call was still pending.
+	Dropped uint64
+}
+
+// Sender forwards each profile to multiple destinations. Each destination
+// has its own queue and goroutine, so a slow or failing destination does not
+// hold up the other ones.
+type Sender struct {
+	logger       pprof.Logger
+	destinations []*destination
+
+	// guards closed and the queues of the destinations
+	lock   sync.RWMutex
+	closed bool
+
+	wg sync.WaitGroup
+}
+
+type destination struct {
+	// counters, only accessed atomically. Those are the first
+	// fields to keep them 64 bit aligned on 32 bit platforms.
+	sent     uint64
+	failed   uint64
+	timedOut uint64
+	dropped  uint64
+
+	Destination
+
+	queue chan *pprof.Profile
+
+	// receives the result of the call abandoned after its timeout, nil if
+	// there is none. Only accessed by the goroutine of the destination.
+	pending chan error
+}
+
+// New creates a new sender and starts a goroutine for each destination.
+func New(config Config) *Sender {
+	if config.Logger == nil {
+		config.Logger = func(format string, args ...interface{}) {}
+	}
+
+	sender := &Sender{logger: config.Logger}
+
+	for _, dest := range config.Destinations {
+		if dest.Timeout == 0 {
+			dest.Timeout = 10 * time.Second
+		}
+
+		if dest.QueueSize == 0 {
+			dest.QueueSize = 16
+		}
+
+		d := &destination{
+			Destination: dest,
+			queue:       make(chan *pprof.Profile, dest.QueueSize),
+		}
+
+		sender.destinations = append(sender.destinations, d)
+
+		sender.wg.Add(1)
+		go sender.run(d)
+	}
+
+	return sender
+}
+
+// Send enqueues the profile for all destinations. It does not wait for
+// the profile to be delivered. An error is only returned, if the profile
+// could not be enqueued for any destination or the sender was closed.
+//
+// As Send returns before the profile is delivered, a Collector using this
+// sender does not retry failed deliveries and does not count them in
+// DroppedProfiles. Failures are counted per destination instead, see Stats.
+func (s *Sender) Send(p *pprof.Profile) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	var enqueued bool
+
+	for _, d := range s.destinations {
+		select {
+		case d.queue <- p:
+			enqueued = true
+
+		default:
+			atomic.AddUint64(&d.dropped, 1)
+			s.logger("Queue of destination %s is full, dropping profile", d.Name)
+		}
+	}
+
+	if !enqueued && len(s.destinations) > 0 {
+		return ErrAllDestinationsFull
+	}
+
+	return nil
+}
+
+// Close stops accepting new profiles and waits until all
+// queued profiles were send to their destinations, or abandoned
+// after their timeout.
+func (s *Sender) Close() error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+
+		for _, d := range s.destinations {
+			close(d.queue)
+		}
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// TakeEncodingTime returns the sum of the encoding times
+// reported by the senders of all destinations.
+func (s *Sender) TakeEncodingTime() time.Duration {
+	var total time.Duration
+
+	for _, d := range s.destinations {
+		if timer, ok := d.Sender.(pprof.EncodingTimer); ok {
+			total += timer.TakeEncodingTime()
+		}
+	}
+
+	return total
+}
+
+// Stats returns the current counters of all destinations.
+func (s *Sender) Stats() []Stats {
+	var stats []Stats
+
+	for _, d := range s.destinations {
+		stats = append(stats, Stats{
+			Name:     d.Name,
+			Sent:     atomic.LoadUint64(&d.sent),
+			Failed:   atomic.LoadUint64(&d.failed),
+			TimedOut: atomic.LoadUint64(&d.timedOut),
+			Dropped:  atomic.LoadUint64(&d.dropped),
+		})
+	}
+
+	return stats
+}
+
+func (s *Sender) run(d *destination) {
+	defer s.wg.Done()
+
+	for profile := range d.queue {
+		s.send(d, profile)
+	}
+}
+
+// send sends the profile to the destination and waits at most the timeout
+// of the destination. After a timeout the pending call is abandoned, so a
+// hanging destination does not block its queue. The result of the
+// abandoned call is only logged. While it is pending, the profiles
+// for the destination are dropped.
+func (s *Sender) send(d *destination, profile *pprof.Profile) {
+	if d.pending != nil {
+		select {
+		case err := <-d.pending:
+			d.pending = nil
+
+			if err != nil {
+				s.logger("Abandoned send to destination %s failed: %s", d.Name, err)
+			}
+
+		default:
+			atomic.AddUint64(&d.dropped, 1)
+			s.logger("Abandoned send to destination %s is still pending, dropping profile", d.Name)
+			return
+		}
+	}
+
+	resultCh := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				resultCh <- fmt.Errorf("sender panicked: %v", r)
+			}
+		}()
+
+		resultCh <- d.Sender.Send(profile)
+	}()
+
+	timer := time.NewTimer(d.Timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-resultCh:
+		s.record(d, err)
+
+	case <-timer.C:
+		atomic.AddUint64(&d.timedOut, 1)
+		s.logger("Sending profile to destination %s timed out after %s", d.Name, d.Timeout)
+
+		d.pending = resultCh
+	}
+}
+
+func (s *Sender) record(d *destination, err error) {
+	if err != nil {
+		atomic.AddUint64(&d.failed, 1)
+		s.logger("Sending profile to destination %s failed: %s", d.Name, err)
+		return
+	}
+
+	atomic.AddUint64(&d.sent, 1)
+}
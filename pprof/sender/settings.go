@@ -0,0 +1,119 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type SettingsConfig struct {
+	Client *http.Client
+
+	// The url of the settings endpoint of the ingest service,
+	// e.g. http://ingest/v1/settings. The name of the
+	// service is appended to the path.
+	BaseURL *url.URL
+	Timeout time.Duration
+}
+
+type settingsSource struct {
+	SettingsConfig
+}
+
+// NewSettingsSource creates a pprof.SettingsSource that fetches
+// the settings of a service from the ingest service.
+func NewSettingsSource(config SettingsConfig) pprof.SettingsSource {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	return &settingsSource{SettingsConfig: config}
+}
+
+func (source *settingsSource) Settings(serviceName string) (*pprof.Settings, error) {
+	ctx := context.Background()
+	if source.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, source.Timeout)
+		defer cancel()
+	}
+
+	settingsURL := *source.BaseURL
+	settingsURL.Path += "/" + url.PathEscape(serviceName)
+
+	req, err := http.NewRequest("GET", settingsURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := source.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// clear the response, so the connection can be reused
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("expected 2xx response, got %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Enabled           bool      `json:"enabled"`
+		SampleFrequencyHz *int      `json:"sampleFrequencyHz"`
+		WindowDurationMs  *int64    `json:"windowDurationMs"`
+		ProfileTypes      *[]string `json:"profileTypes"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode settings: %s", err)
+	}
+
+	settings := &pprof.Settings{Enabled: body.Enabled}
+
+	if body.SampleFrequencyHz != nil {
+		settings.SampleFrequencyHz = *body.SampleFrequencyHz
+	}
+
+	if body.WindowDurationMs != nil {
+		settings.WindowDuration = time.Duration(*body.WindowDurationMs) * time.Millisecond
+	}
+
+	if body.ProfileTypes != nil {
+		settings.ProfileTypes = []pprof.ProfileType{}
+
+		for _, name := range *body.ProfileTypes {
+			profileType, err := profileTypeOf(name)
+			if err != nil {
+				return nil, err
+			}
+
+			settings.ProfileTypes = append(settings.ProfileTypes, profileType)
+		}
+	}
+
+	return settings, nil
+}
+
+// profileTypeOf returns the profile type with the given name.
+func profileTypeOf(name string) (pprof.ProfileType, error) {
+	for profileType := pprof.ProfileTypeCPU; profileType <= pprof.ProfileTypeGoroutine; profileType++ {
+		if profileType.String() == name {
+			return profileType, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown profile type '%s'", name)
+}
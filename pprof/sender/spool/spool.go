@@ -0,0 +1,310 @@
+package spool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// magic bytes at the start of each spool file
+var magic = [4]byte{'A', 'P', 'S', 'P'}
+
+const formatVersion = 1
+
+// size of the header: magic, version, payload length and checksum.
+const headerSize = 4 + 1 + 4 + 4
+
+const fileSuffix = ".profile"
+
+type Config struct {
+	// the sender to deliver the profiles to.
+	Sender pprof.Sender
+	Logger pprof.Logger
+
+	// The directory to write the profiles to. It is created if it does not exist.
+	Directory string
+
+	// The maximum size of all spooled profiles in bytes. If the limit is
+	// reached, the oldest profiles are deleted. Defaults to 64MB.
+	MaxSize int64
+}
+
+type spoolFile struct {
+	seq  uint64
+	size int64
+}
+
+// permanentError is implemented by errors of senders that know that sending
+// the same profile again would fail too, see sender.StatusError.
+type permanentError interface {
+	Permanent() bool
+}
+
+func isPermanent(err error) bool {
+	permanent, ok := err.(permanentError)
+	return ok && permanent.Permanent()
+}
+
+type sender struct {
+	Config
+
+	lock sync.Mutex
+
+	// spooled files, oldest first
+	files []spoolFile
+	size  int64
+
+	nextSeq uint64
+}
+
+// New creates a sender that writes profiles to the spool directory if the
+// wrapped sender fails to deliver them. Spooled profiles are delivered in order
+// before the next profile, once the wrapped sender is reachable again. Profiles
+// spooled by a previous process are picked up.
+func New(config Config) (pprof.Sender, error) {
+	if config.Sender == nil {
+		return nil, errors.New("no sender configured")
+	}
+
+	if config.Directory == "" {
+		return nil, errors.New("no spool directory configured")
+	}
+
+	if config.MaxSize == 0 {
+		config.MaxSize = 64 * 1024 * 1024
+	}
+
+	if config.Logger == nil {
+		config.Logger = func(format string, args ...interface{}) {}
+	}
+
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("create spool directory: %s", err)
+	}
+
+	s := &sender{Config: config}
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *sender) Send(p *pprof.Profile) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// deliver spooled profiles first to keep the order
+	if err := s.replay(); err != nil {
+		return s.spool(p)
+	}
+
+	if err := s.Sender.Send(p); err != nil {
+		if isPermanent(err) {
+			// spooling would not help, the profile is rejected again
+			return err
+		}
+
+		s.Logger("Sending profile failed, spooling profile to disk: %s", err)
+		return s.spool(p)
+	}
+
+	return nil
+}
+
+// TakeEncodingTime returns the encoding time reported by the wrapped sender.
+func (s *sender) TakeEncodingTime() time.Duration {
+	if timer, ok := s.Sender.(pprof.EncodingTimer); ok {
+		return timer.TakeEncodingTime()
+	}
+
+	return 0
+}
+
+// replay sends all spooled profiles in order. It stops at the first error and
+// keeps the profile for the next attempt, unless the receiver rejected the
+// profile. A rejected profile would block the profiles after it forever, so
+// it is deleted.
+func (s *sender) replay() error {
+	for len(s.files) > 0 {
+		file := s.files[0]
+
+		profile, err := readProfile(s.path(file.seq))
+		if err != nil {
+			// the file was truncated or is otherwise broken, skip it.
+			s.Logger("Skipping broken spool file %s: %s", s.path(file.seq), err)
+			s.remove(0)
+			continue
+		}
+
+		if err := s.Sender.Send(profile); err != nil {
+			if !isPermanent(err) {
+				return err
+			}
+
+			s.Logger("Deleting rejected spool file %s: %s", s.path(file.seq), err)
+		}
+
+		s.remove(0)
+	}
+
+	return nil
+}
+
+// spool writes the profile to the spool directory. The profile is written
+// to a temporary file first, so a crash does not leave a partial file.
+func (s *sender) spool(p *pprof.Profile) error {
+	content, err := encodeProfile(p)
+	if err != nil {
+		return err
+	}
+
+	seq := s.nextSeq
+	path := s.path(seq)
+
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, content, 0644); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("write spool file: %s", err)
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("rename spool file: %s", err)
+	}
+
+	s.nextSeq++
+	s.files = append(s.files, spoolFile{seq: seq, size: int64(len(content))})
+	s.size += int64(len(content))
+
+	// delete the oldest files until we are below the limit again
+	for s.size > s.MaxSize && len(s.files) > 1 {
+		s.Logger("Spool directory is full, deleting oldest profile")
+		s.remove(0)
+	}
+
+	return nil
+}
+
+// remove deletes the spool file at the given index.
+func (s *sender) remove(idx int) {
+	file := s.files[idx]
+
+	if err := os.Remove(s.path(file.seq)); err != nil && !os.IsNotExist(err) {
+		s.Logger("Could not delete spool file: %s", err)
+	}
+
+	s.size -= file.size
+	s.files = append(s.files[:idx], s.files[idx+1:]...)
+}
+
+// scan reads the existing files of the spool directory
+// and removes left over temporary files.
+func (s *sender) scan() error {
+	entries, err := ioutil.ReadDir(s.Directory)
+	if err != nil {
+		return fmt.Errorf("read spool directory: %s", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if strings.HasSuffix(name, fileSuffix+".tmp") {
+			_ = os.Remove(filepath.Join(s.Directory, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, fileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.files = append(s.files, spoolFile{seq: seq, size: entry.Size()})
+		s.size += entry.Size()
+
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].seq < s.files[j].seq })
+
+	return nil
+}
+
+func (s *sender) path(seq uint64) string {
+	return filepath.Join(s.Directory, fmt.Sprintf("%020d%s", seq, fileSuffix))
+}
+
+func encodeProfile(p *pprof.Profile) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// reserve space for the header
+	buf.Write(make([]byte, headerSize))
+
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return nil, fmt.Errorf("encode profile: %s", err)
+	}
+
+	content := buf.Bytes()
+	payload := content[headerSize:]
+
+	copy(content[0:4], magic[:])
+	content[4] = formatVersion
+	binary.BigEndian.PutUint32(content[5:9], uint32(len(payload)))
+	binary.BigEndian.PutUint32(content[9:13], crc32.ChecksumIEEE(payload))
+
+	return content, nil
+}
+
+func readProfile(path string) (*pprof.Profile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) < headerSize {
+		return nil, errors.New("truncated header")
+	}
+
+	if !bytes.Equal(content[0:4], magic[:]) {
+		return nil, errors.New("not a spool file")
+	}
+
+	if content[4] != formatVersion {
+		return nil, fmt.Errorf("unsupported format version %d", content[4])
+	}
+
+	payload := content[headerSize:]
+
+	if length := binary.BigEndian.Uint32(content[5:9]); uint32(len(payload)) != length {
+		return nil, fmt.Errorf("truncated payload, expected %d bytes, got %d", length, len(payload))
+	}
+
+	if checksum := binary.BigEndian.Uint32(content[9:13]); crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	var profile pprof.Profile
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("decode profile: %s", err)
+	}
+
+	return &profile, nil
+}
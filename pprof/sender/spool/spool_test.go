@@ -0,0 +1,169 @@
+package spool
+
+import (
+	"errors"
+	"github.com/flachnetz/alwaysprofile/pprof"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var errUnavailable = errors.New("receiver unavailable")
+
+// rejectedError is returned by a receiver that will never accept the profile.
+type rejectedError struct{}
+
+func (rejectedError) Error() string   { return "profile rejected" }
+func (rejectedError) Permanent() bool { return true }
+
+// fakeSender returns the queued errors in order and
+// records the profiles it accepted.
+type fakeSender struct {
+	errs []error
+	sent []string
+}
+
+func (f *fakeSender) Send(p *pprof.Profile) error {
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+
+		if err != nil {
+			return err
+		}
+	}
+
+	f.sent = append(f.sent, p.ServiceName)
+	return nil
+}
+
+func tempDir(t *testing.T) string {
+	directory, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("create spool directory: %s", err)
+	}
+
+	return directory
+}
+
+func newTestSender(t *testing.T, directory string, target pprof.Sender) pprof.Sender {
+	s, err := New(Config{Sender: target, Directory: directory})
+	if err != nil {
+		t.Fatalf("create spool sender: %s", err)
+	}
+
+	return s
+}
+
+func send(t *testing.T, s pprof.Sender, name string) {
+	if err := s.Send(&pprof.Profile{ServiceName: name}); err != nil {
+		t.Fatalf("send %s: %s", name, err)
+	}
+}
+
+func spooledFiles(t *testing.T, directory string) int {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("read spool directory: %s", err)
+	}
+
+	var count int
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), fileSuffix) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func expectSent(t *testing.T, target *fakeSender, expected ...string) {
+	if strings.Join(target.sent, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v to be sent, got %v", expected, target.sent)
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+
+	target := &fakeSender{errs: []error{errUnavailable, errUnavailable}}
+
+	s := newTestSender(t, directory, target)
+	send(t, s, "a")
+	send(t, s, "b")
+
+	if count := spooledFiles(t, directory); count != 2 {
+		t.Fatalf("expected 2 spooled profiles, got %d", count)
+	}
+
+	// a new process picks up the spooled profiles and sends them in order
+	s = newTestSender(t, directory, target)
+	send(t, s, "c")
+
+	expectSent(t, target, "a", "b", "c")
+
+	if count := spooledFiles(t, directory); count != 0 {
+		t.Errorf("expected spool to be empty, got %d profiles", count)
+	}
+}
+
+func TestSpoolReplayKeepsProfileOnError(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+
+	target := &fakeSender{errs: []error{errUnavailable}}
+
+	s := newTestSender(t, directory, target)
+	send(t, s, "a")
+
+	// replaying "a" fails again, so it is kept and "b" is spooled behind it
+	target.errs = []error{errUnavailable, errUnavailable}
+	send(t, s, "b")
+	send(t, s, "c")
+
+	if count := spooledFiles(t, directory); count != 3 {
+		t.Fatalf("expected 3 spooled profiles, got %d", count)
+	}
+
+	send(t, s, "d")
+	expectSent(t, target, "a", "b", "c", "d")
+}
+
+func TestSpoolReplayDeletesRejectedProfile(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+
+	target := &fakeSender{errs: []error{errUnavailable, errUnavailable}}
+
+	s := newTestSender(t, directory, target)
+	send(t, s, "a")
+	send(t, s, "b")
+
+	// the receiver rejects "a" on replay, which must not block "b"
+	target.errs = []error{rejectedError{}}
+	send(t, s, "c")
+
+	expectSent(t, target, "b", "c")
+
+	if count := spooledFiles(t, directory); count != 0 {
+		t.Errorf("expected rejected profile to be deleted, got %d profiles", count)
+	}
+}
+
+func TestSpoolDoesNotSpoolRejectedProfile(t *testing.T) {
+	directory := tempDir(t)
+	defer os.RemoveAll(directory)
+
+	target := &fakeSender{errs: []error{rejectedError{}}}
+
+	s := newTestSender(t, directory, target)
+	if err := s.Send(&pprof.Profile{ServiceName: "a"}); err == nil {
+		t.Error("expected the rejection to be returned")
+	}
+
+	if count := spooledFiles(t, directory); count != 0 {
+		t.Errorf("expected rejected profile not to be spooled, got %d profiles", count)
+	}
+}
@@ -0,0 +1,147 @@
+package pprof
+
+import (
+	"fmt"
+	"time"
+)
+
+// Settings are the parts of the configuration that can be changed while the
+// profiler is running. They are provided by a SettingsSource, e.g. the
+// ingest service, so that profiling can be turned up or off for a
+// service without redeploying it.
+type Settings struct {
+	// Disables all profiling if false.
+	Enabled bool
+
+	// The sample frequency of the cpu profiler. If adaptive sampling
+	// is enabled, this is the maximum frequency. Zero keeps the
+	// frequency of the local configuration.
+	SampleFrequencyHz int
+
+	// The length of a profile window. Zero keeps the
+	// window duration of the local configuration.
+	WindowDuration time.Duration
+
+	// The profile types to collect. Only profile types that are enabled
+	// in the local configuration can be collected. A nil slice enables
+	// all of them, an empty slice disables all of them.
+	ProfileTypes []ProfileType
+}
+
+// SettingsSource provides the settings for a service.
+type SettingsSource interface {
+	Settings(serviceName string) (*Settings, error)
+}
+
+func (settings *Settings) validate(config *Config) error {
+	switch {
+	case settings.SampleFrequencyHz < 0 || settings.SampleFrequencyHz > 1000:
+		return fmt.Errorf("sample frequency must be between 0 and 1000, got %d", settings.SampleFrequencyHz)
+
+	case settings.WindowDuration < 0:
+		return fmt.Errorf("window duration must not be negative, got %s", settings.WindowDuration)
+
+	case settings.WindowDuration > 0 && settings.WindowDuration < config.ReadInterval:
+		return fmt.Errorf("window duration %s must not be shorter than the read interval %s",
+			settings.WindowDuration, config.ReadInterval)
+	}
+
+	return nil
+}
+
+// pollSettings periodically fetches the settings from the SettingsSource
+// until the profiler is stopped. The latest settings are picked
+// up by the loop at the end of the current window.
+func (p *profiler) pollSettings() {
+	ticker := time.NewTicker(p.SettingsPollInterval)
+	defer ticker.Stop()
+
+	for {
+		settings, err := p.SettingsSource.Settings(p.ServiceName)
+		switch {
+		case err != nil:
+			p.Logger("Fetch profiler settings: %s", err)
+
+		case settings != nil:
+			if err := settings.validate(&p.Config); err != nil {
+				p.Logger("Ignoring invalid profiler settings: %s", err)
+				break
+			}
+
+			p.settingsLock.Lock()
+			p.pendingSettings = settings
+			p.settingsLock.Unlock()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+// takeSettings returns the settings received since the previous call, if any.
+func (p *profiler) takeSettings() *Settings {
+	p.settingsLock.Lock()
+	defer p.settingsLock.Unlock()
+
+	settings := p.pendingSettings
+	p.pendingSettings = nil
+
+	return settings
+}
+
+// applySettings applies the given settings to the running profiler. If the
+// cpu profiler needs to be reconfigured, the remaining samples are added
+// to the given profile first. It returns false, if the profiler was
+// stopped in the meantime.
+func (p *profiler) applySettings(profile *Profile, settings *Settings) bool {
+	p.settings = *settings
+
+	p.WindowDuration = p.local.WindowDuration
+	if settings.WindowDuration > 0 {
+		p.WindowDuration = settings.WindowDuration
+	}
+
+	hz := p.local.SampleFrequencyHz
+	if settings.SampleFrequencyHz > 0 {
+		hz = settings.SampleFrequencyHz
+	}
+
+	cpuEnabled := p.profileTypeEnabled(ProfileTypeCPU)
+	if hz == p.SampleFrequencyHz && cpuEnabled == (p.sampleFrequencyHz > 0) {
+		return true
+	}
+
+	p.Logger("Applying profiler settings: enabled=%t, cpu=%t, frequency=%dHz, window=%s",
+		settings.Enabled, cpuEnabled, hz, p.WindowDuration)
+
+	p.SampleFrequencyHz = hz
+
+	if !cpuEnabled {
+		hz = 0
+	}
+
+	return p.changeSampleFrequency(profile, hz)
+}
+
+// profileTypeEnabled returns true, if the current settings
+// allow to collect profiles of the given type.
+func (p *profiler) profileTypeEnabled(profileType ProfileType) bool {
+	if !p.settings.Enabled {
+		return false
+	}
+
+	if p.settings.ProfileTypes == nil {
+		return true
+	}
+
+	for _, enabled := range p.settings.ProfileTypes {
+		if enabled == profileType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,153 @@
+package pprof
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	runtimepprof "runtime/pprof"
+	"sync"
+	"time"
+)
+
+// The labels that are set on a goroutine for the lifetime of a span.
+// Samples recorded while a span is active carry those labels.
+const (
+	LabelSpan    = "span"
+	LabelSpanId  = "span_id"
+	LabelTraceId = "trace_id"
+)
+
+// SpanRecord describes a span that has ended. The finished spans of a window
+// are sent with the cpu profile, so that the samples of a trace can be
+// found by the duration of its spans.
+type SpanRecord struct {
+	Name     string
+	TraceId  string
+	SpanId   string
+	Start    time.Time
+	Duration time.Duration
+}
+
+type traceIdKey struct{}
+
+// WithTraceId returns a context that uses the given trace id for all spans
+// started from it. Use this to link the samples with the traces of an
+// existing tracing system.
+func WithTraceId(ctx context.Context, traceId string) context.Context {
+	return context.WithValue(ctx, traceIdKey{}, traceId)
+}
+
+// TraceId returns the trace id of the span in the given context. It
+// returns an empty string, if the context does not belong to a trace.
+func TraceId(ctx context.Context) string {
+	traceId, _ := ctx.Value(traceIdKey{}).(string)
+	return traceId
+}
+
+// Span starts a span with the given name, e.g. the name of an endpoint. The
+// current goroutine is labeled with the name of the span, the span id and
+// the trace id until the returned function is called. Spans started from
+// the returned context belong to the same trace. To label other goroutines,
+// use runtime/pprof.SetGoroutineLabels with the returned context.
+//
+//	ctx, end := pprof.Span(ctx, "GET /users")
+//	defer end()
+func Span(ctx context.Context, name string) (context.Context, func()) {
+	traceId := TraceId(ctx)
+	if traceId == "" {
+		traceId = fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+	}
+
+	spanId := fmt.Sprintf("%016x", rand.Uint64())
+
+	spanCtx := WithTraceId(ctx, traceId)
+	spanCtx = runtimepprof.WithLabels(spanCtx, runtimepprof.Labels(
+		LabelSpan, name,
+		LabelSpanId, spanId,
+		LabelTraceId, traceId))
+
+	runtimepprof.SetGoroutineLabels(spanCtx)
+
+	startTime := time.Now()
+
+	end := func() {
+		// restore the labels of the parent
+		runtimepprof.SetGoroutineLabels(ctx)
+
+		spans.record(SpanRecord{
+			Name:     name,
+			TraceId:  traceId,
+			SpanId:   spanId,
+			Start:    startTime,
+			Duration: time.Since(startTime),
+		})
+	}
+
+	return spanCtx, end
+}
+
+// spans records the finished spans of the running profiler.
+var spans spanRecorder
+
+// spanRecorder keeps the slowest of the spans that
+// finished since the previous call to take.
+type spanRecorder struct {
+	lock     sync.Mutex
+	capacity int
+	records  spanHeap
+}
+
+// enable starts recording at most capacity spans per window.
+// A capacity of zero disables recording.
+func (r *spanRecorder) enable(capacity int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.capacity = capacity
+	r.records = nil
+}
+
+func (r *spanRecorder) record(span SpanRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch {
+	case r.capacity <= 0:
+		return
+
+	case len(r.records) < r.capacity:
+		heap.Push(&r.records, span)
+
+	case r.records[0].Duration < span.Duration:
+		// replace the fastest span
+		r.records[0] = span
+		heap.Fix(&r.records, 0)
+	}
+}
+
+// take returns the recorded spans and starts a new window.
+func (r *spanRecorder) take() []SpanRecord {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	records := r.records
+	r.records = nil
+
+	return records
+}
+
+// spanHeap is a min-heap of spans ordered by duration.
+type spanHeap []SpanRecord
+
+func (h spanHeap) Len() int            { return len(h) }
+func (h spanHeap) Less(i, j int) bool  { return h[i].Duration < h[j].Duration }
+func (h spanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *spanHeap) Push(x interface{}) { *h = append(*h, x.(SpanRecord)) }
+
+func (h *spanHeap) Pop() interface{} {
+	old := *h
+	span := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return span
+}
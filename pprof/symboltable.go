@@ -0,0 +1,122 @@
+package pprof
+
+import (
+	"runtime"
+	"sync"
+)
+
+// processSymbols is shared by all profiles of the process, so each pc
+// is only symbolized once and a method keeps its id across windows
+// and even across restarts of the profiler.
+var processSymbols = symbolTable{
+	methods:   map[methodKey]MethodId{},
+	locations: map[locationKey][]MethodId{},
+}
+
+// symbolTable assigns stable ids to the methods of the process. The
+// names are only ever appended, so a profile can reference a prefix
+// of them without copying, and a receiver that knows the first n
+// names only needs the names after that.
+type symbolTable struct {
+	lock sync.Mutex
+
+	methods   map[methodKey]MethodId
+	locations map[locationKey][]MethodId
+
+	names []string
+	files []string
+	lines []int32
+}
+
+// locationKey identifies the frames at a pc. The frames differ
+// depending on whether file and line information is included.
+type locationKey struct {
+	addr         uintptr
+	includeLines bool
+}
+
+// locForPC returns the lookup ids of the functions for addr.
+// addr must a return PC or 1 + the PC of an inline marker.
+// This returns the location of the corresponding call. As
+// multiple functions can be inlined at the same PC, the result
+// contains all logical frames, innermost (leaf) frame first.
+func (table *symbolTable) locForPC(addr uintptr, includeLines bool) []MethodId {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	key := locationKey{addr: addr, includeLines: includeLines}
+	if loc, ok := table.locations[key]; ok {
+		return loc
+	}
+
+	// Expand this one address using CallersFrames so we can cache
+	// each expansion. In general, CallersFrames takes a whole
+	// stack, but in this case we know there will be no skips in
+	// the stack and we have return PCs anyway.
+	frames := runtime.CallersFrames([]uintptr{addr})
+
+	var methodIds []MethodId
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.goexit" {
+			// Short-circuit if we see runtime.goexit so the loop
+			// below doesn't allocate a useless empty location.
+			break
+		}
+
+		if frame.Function != "" {
+			methodIds = append(methodIds, table.methodIdLocked(frame, includeLines))
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	// cache location by address
+	table.locations[key] = methodIds
+
+	return methodIds
+}
+
+// methodId returns the id of the method of the given frame,
+// registering the method if it was not seen before.
+func (table *symbolTable) methodId(frame runtime.Frame, includeLines bool) MethodId {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	return table.methodIdLocked(frame, includeLines)
+}
+
+func (table *symbolTable) methodIdLocked(frame runtime.Frame, includeLines bool) MethodId {
+	key := methodKey{Function: frame.Function}
+	if includeLines {
+		key.File = frame.File
+		key.Line = frame.Line
+	}
+
+	// check if we already know the function
+	if methodId, ok := table.methods[key]; ok {
+		return methodId
+	}
+
+	// method not known, cache it
+	methodId := MethodId(len(table.names))
+	table.methods[key] = methodId
+	table.names = append(table.names, key.Function)
+	table.files = append(table.files, key.File)
+	table.lines = append(table.lines, int32(key.Line))
+
+	return methodId
+}
+
+// snapshot returns the names, files and lines of all methods
+// registered until now. The slices must not be modified.
+func (table *symbolTable) snapshot() (names, files []string, lines []int32) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	return table.names[:len(table.names):len(table.names)],
+		table.files[:len(table.files):len(table.files)],
+		table.lines[:len(table.lines):len(table.lines)]
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/NYTimes/gziphandler"
 	"github.com/flachnetz/startup"
 	base "github.com/flachnetz/startup/startup_base"
@@ -12,6 +14,8 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -39,6 +43,17 @@ func main() {
 			router.GET("/api/v1/services", HandlerServices(db))
 			router.GET("/api/v1/services/:service/stack", HandlerStack(db, repo))
 			router.GET("/api/v1/services/:service/histogram", HandlerHistogram(db))
+			router.GET("/api/v1/services/:service/heap", HandlerValueStack(db, repo, "heap",
+				"alloc_bytes", "alloc_objects", "inuse_bytes", "inuse_objects"))
+			router.GET("/api/v1/services/:service/mutex", HandlerValueStack(db, repo, "mutex", "delay", "contentions"))
+			router.GET("/api/v1/services/:service/block", HandlerValueStack(db, repo, "block", "delay", "contentions"))
+			router.GET("/api/v1/services/:service/goroutines", HandlerValueStack(db, repo, "goroutine", "goroutines"))
+			router.GET("/api/v1/services/:service/goroutines/count", HandlerGoroutineCount(db))
+			router.GET("/api/v1/services/:service/metrics", HandlerRuntimeMetrics(db))
+			router.GET("/api/v1/services/:service/lost-samples", HandlerLostSamples(db))
+			router.GET("/api/v1/services/:service/spans", HandlerSpans(db))
+			router.GET("/api/v1/services/:service/spans/stack", HandlerSpanStack(db, repo))
+			router.GET("/api/v1/services/:service/traces/:trace/stack", HandlerSpanStack(db, repo))
 			router.ServeFiles("/ui/*filepath", http.Dir("./ui/dist/ui/"))
 			return gziphandler.GzipHandler(router)
 		},
@@ -72,7 +87,12 @@ func HandlerStack(db *sqlx.DB, repo *Repository) httprouter.Handle {
 		}
 
 		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
-			return queryStack(request.Context(), db, repo, opts.Service)
+			filter, err := sampleFilterOf(request)
+			if err != nil {
+				return nil, err
+			}
+
+			return queryStack(request.Context(), db, repo, opts.Service, filter)
 		})
 	}
 }
@@ -84,11 +104,162 @@ func HandlerHistogram(db *sqlx.DB) httprouter.Handle {
 		}
 
 		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
-			return queryHistogram(request.Context(), db, opts.Service, 5*time.Minute)
+			filter, err := sampleFilterOf(request)
+			if err != nil {
+				return nil, err
+			}
+
+			return queryHistogram(request.Context(), db, opts.Service, filter, 5*time.Minute)
 		})
 	}
 }
 
+func HandlerGoroutineCount(db *sqlx.DB) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
+			return queryGoroutineCount(request.Context(), db, opts.Service, 5*time.Minute)
+		})
+	}
+}
+
+func HandlerRuntimeMetrics(db *sqlx.DB) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
+			return queryRuntimeMetrics(request.Context(), db, opts.Service, 5*time.Minute)
+		})
+	}
+}
+
+func HandlerLostSamples(db *sqlx.DB) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
+			return queryLostSamples(request.Context(), db, opts.Service, 5*time.Minute)
+		})
+	}
+}
+
+// HandlerValueStack serves the stacks of a non cpu profile type, like heap or
+// mutex profiles. The value type is selected by the "value" query parameter,
+// it defaults to the first of the given value types. The time range is
+// selected by the "from" and "to" query parameters, see timeRangeOf.
+func HandlerValueStack(db *sqlx.DB, repo *Repository, profileType string, valueTypes ...string) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
+			valueType := request.URL.Query().Get("value")
+			if valueType == "" {
+				valueType = valueTypes[0]
+			}
+
+			if !containsString(valueTypes, valueType) {
+				return nil, fmt.Errorf("invalid %s value type '%s', expected one of %s",
+					profileType, valueType, strings.Join(valueTypes, ", "))
+			}
+
+			timeMin, timeMax, err := timeRangeOf(request)
+			if err != nil {
+				return nil, err
+			}
+
+			return queryValueStack(request.Context(), db, repo, opts.Service, profileType, valueType, timeMin, timeMax)
+		})
+	}
+}
+
+// timeRangeOf parses the time range of the request. The "from" and "to" query
+// parameters are given in seconds since the epoch and default to the epoch
+// and the current time.
+func timeRangeOf(request *http.Request) (timeMin, timeMax int64, err error) {
+	query := request.URL.Query()
+
+	timeMax = time.Now().Unix()
+
+	if from := query.Get("from"); from != "" {
+		if timeMin, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid time '%s' in from, expected seconds since epoch", from)
+		}
+	}
+
+	if to := query.Get("to"); to != "" {
+		if timeMax, err = strconv.ParseInt(to, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid time '%s' in to, expected seconds since epoch", to)
+		}
+	}
+
+	if timeMin > timeMax {
+		return 0, 0, fmt.Errorf("time range from %d must not be after to %d", timeMin, timeMax)
+	}
+
+	return timeMin, timeMax, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SampleFilter restricts the samples that are included in a query.
+type SampleFilter struct {
+	// only samples having all of those labels are included.
+	Labels types.JSONText
+
+	// the kind of samples to include, e.g. cpu or offcpu. If
+	// empty, samples of all kinds are included.
+	Kind string
+}
+
+// sampleFilterOf parses the sample filter of the request. Each label filter
+// is given as a "label=key:value" query parameter, only samples having all
+// of the given labels will match the filter. The kind of samples can be
+// selected using the "kind" query parameter.
+func sampleFilterOf(request *http.Request) (SampleFilter, error) {
+	query := request.URL.Query()
+
+	labels := map[string]string{}
+	for _, label := range query["label"] {
+		idx := strings.IndexByte(label, ':')
+		if idx <= 0 {
+			return SampleFilter{}, fmt.Errorf("invalid label filter '%s', expected key:value", label)
+		}
+
+		labels[label[:idx]] = label[idx+1:]
+	}
+
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return SampleFilter{}, errors.WithMessage(err, "encode label filter")
+	}
+
+	kind := query.Get("kind")
+	switch kind {
+	case "", "cpu", "offcpu":
+	default:
+		return SampleFilter{}, fmt.Errorf("invalid sample kind '%s', expected cpu or offcpu", kind)
+	}
+
+	return SampleFilter{Labels: types.JSONText(encoded), Kind: kind}, nil
+}
+
 func queryServiceNames(ctx context.Context, db *sqlx.DB) ([]string, error) {
 	var names []string
 	err := db.SelectContext(ctx, &names, `SELECT name FROM ap_service ORDER BY name ASC`)
@@ -100,7 +271,7 @@ type HistogramBin struct {
 	Value            int `json:"sampleCount" db:"sample_count"`
 }
 
-func queryHistogram(ctx context.Context, db *sqlx.DB, serviceName string, binSize time.Duration) ([]HistogramBin, error) {
+func queryHistogram(ctx context.Context, db *sqlx.DB, serviceName string, filter SampleFilter, binSize time.Duration) ([]HistogramBin, error) {
 	var histogram []HistogramBin
 
 	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
@@ -109,7 +280,152 @@ func queryHistogram(ctx context.Context, db *sqlx.DB, serviceName string, binSiz
 					sum((item).duration) as sample_count
 			FROM ap_sample, unnest(ap_sample.items) as item
 			WHERE ap_sample.instance_id = ANY(ap_instances_of($2))
-			GROUP BY 1`, binSize/time.Second, serviceName)
+			  AND ap_sample.labels @> $3
+			  AND ($4::TEXT = '' OR ap_sample.kind = $4)
+			GROUP BY 1`, binSize/time.Second, serviceName, filter.Labels, filter.Kind)
+	})
+
+	return histogram, err
+}
+
+type GoroutineCountBin struct {
+	TimeslotInMillis int64 `json:"timeslotInMillis" db:"timeslot"`
+	Average          int64 `json:"average" db:"average"`
+	Max              int64 `json:"max" db:"max"`
+}
+
+// queryGoroutineCount returns the number of goroutines of all instances of a
+// service over time. The average and maximum of each bin is the sum of the
+// averages and maximums of all instances.
+func queryGoroutineCount(ctx context.Context, db *sqlx.DB, serviceName string, binSize time.Duration) ([]GoroutineCountBin, error) {
+	var histogram []GoroutineCountBin
+
+	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &histogram, `
+			WITH per_timeslot AS (
+				SELECT timeslot,
+						sum(total::FLOAT8 / windows) as average,
+						sum(max) as max
+				FROM ap_goroutine_count
+				WHERE instance_id = ANY(ap_instances_of($2))
+				GROUP BY timeslot)
+
+			SELECT (timeslot / $1)::INT8 * $1 * 1000 as timeslot,
+					avg(average)::INT8 as average,
+					max(max) as max
+			FROM per_timeslot
+			GROUP BY 1
+			ORDER BY 1`, binSize/time.Second, serviceName)
+	})
+
+	return histogram, err
+}
+
+type RuntimeMetricsBin struct {
+	TimeslotInMillis int64 `json:"timeslotInMillis" db:"timeslot"`
+
+	// average heap statistics in bytes and objects
+	HeapInUse   int64 `json:"heapInUse" db:"heap_inuse"`
+	HeapAlloc   int64 `json:"heapAlloc" db:"heap_alloc"`
+	HeapObjects int64 `json:"heapObjects" db:"heap_objects"`
+
+	// maximum of the in-use heap in bytes
+	HeapInUseMax int64 `json:"heapInUseMax" db:"heap_inuse_max"`
+
+	// number of gc cycles and the gc pause time in this bin
+	GCCount         int64   `json:"gcCount" db:"gc_count"`
+	GCPauseInMillis float64 `json:"gcPauseInMillis" db:"gc_pause"`
+
+	GoroutinesMax int64 `json:"goroutinesMax" db:"goroutines_max"`
+	GOMAXPROCS    int64 `json:"gomaxprocs" db:"gomaxprocs"`
+}
+
+// queryRuntimeMetrics returns the runtime metrics of all instances of a
+// service over time. The values of each bin are the sums over all instances.
+// The agents send gc totals, so the number of gc cycles and the pause time
+// of a timeslot are the differences to the previous timeslot of the instance.
+func queryRuntimeMetrics(ctx context.Context, db *sqlx.DB, serviceName string, binSize time.Duration) ([]RuntimeMetricsBin, error) {
+	var histogram []RuntimeMetricsBin
+
+	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &histogram, `
+			WITH per_instance AS (
+				SELECT timeslot,
+						heap_inuse_total::FLOAT8 / windows as heap_inuse,
+						heap_alloc_total::FLOAT8 / windows as heap_alloc,
+						heap_objects_total::FLOAT8 / windows as heap_objects,
+						heap_inuse_max,
+						GREATEST(0, num_gc - lag(num_gc, 1, num_gc) OVER w) as gc_count,
+						GREATEST(0, pause_total_ns - lag(pause_total_ns, 1, pause_total_ns) OVER w) as gc_pause_ns,
+						goroutines_max,
+						gomaxprocs
+				FROM ap_runtime_metrics
+				WHERE instance_id = ANY(ap_instances_of($2))
+				WINDOW w AS (PARTITION BY instance_id ORDER BY timeslot)),
+
+			per_timeslot AS (
+				SELECT timeslot,
+						sum(heap_inuse) as heap_inuse,
+						sum(heap_alloc) as heap_alloc,
+						sum(heap_objects) as heap_objects,
+						sum(heap_inuse_max) as heap_inuse_max,
+						sum(gc_count) as gc_count,
+						sum(gc_pause_ns) as gc_pause_ns,
+						sum(goroutines_max) as goroutines_max,
+						sum(gomaxprocs) as gomaxprocs
+				FROM per_instance
+				GROUP BY timeslot)
+
+			SELECT (timeslot / $1)::INT8 * $1 * 1000 as timeslot,
+					avg(heap_inuse)::INT8 as heap_inuse,
+					avg(heap_alloc)::INT8 as heap_alloc,
+					avg(heap_objects)::INT8 as heap_objects,
+					max(heap_inuse_max)::INT8 as heap_inuse_max,
+					sum(gc_count)::INT8 as gc_count,
+					(sum(gc_pause_ns) / 1e6)::FLOAT8 as gc_pause,
+					max(goroutines_max)::INT8 as goroutines_max,
+					max(gomaxprocs)::INT8 as gomaxprocs
+			FROM per_timeslot
+			GROUP BY 1
+			ORDER BY 1`, binSize/time.Second, serviceName)
+	})
+
+	return histogram, err
+}
+
+type LostSamplesBin struct {
+	TimeslotInMillis int64 `json:"timeslotInMillis" db:"timeslot"`
+
+	// the sum of the durations of all cpu samples
+	CPUTimeInMillis int64 `json:"cpuTimeInMillis" db:"cpu_time"`
+
+	// number of samples the runtime could not record and the
+	// number of profiles the agents dropped before sending them
+	LostSamples     int64 `json:"lostSamples" db:"lost_samples"`
+	DroppedProfiles int64 `json:"droppedProfiles" db:"dropped_profiles"`
+
+	// the largest difference between the wall clock and the monotonic
+	// clock of an instance. Sample timestamps might be off by this amount.
+	MaxClockDriftInMillis int64 `json:"maxClockDriftInMillis" db:"max_clock_drift"`
+}
+
+// queryLostSamples returns the number of lost samples and dropped profiles
+// of all instances of a service over time. A profile of a bin with many
+// lost samples or dropped profiles should not be trusted.
+func queryLostSamples(ctx context.Context, db *sqlx.DB, serviceName string, binSize time.Duration) ([]LostSamplesBin, error) {
+	var histogram []LostSamplesBin
+
+	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &histogram, `
+			SELECT (timeslot / $1)::INT8 * $1 * 1000 as timeslot,
+					sum(cpu_time_ms)::INT8 as cpu_time,
+					sum(lost_samples)::INT8 as lost_samples,
+					sum(dropped_profiles)::INT8 as dropped_profiles,
+					max(max_clock_drift_ms)::INT8 as max_clock_drift
+			FROM ap_sample_stats
+			WHERE instance_id = ANY(ap_instances_of($2))
+			GROUP BY 1
+			ORDER BY 1`, binSize/time.Second, serviceName)
 	})
 
 	return histogram, err
@@ -118,16 +434,18 @@ func queryHistogram(ctx context.Context, db *sqlx.DB, serviceName string, binSiz
 type Stack struct {
 	Methods          []string `json:"methods"`
 	DurationInMillis int32    `json:"durationInMillis"`
+
+	// source file and line of each method, only
+	// set if the agent included line information.
+	Files []string `json:"files,omitempty"`
+	Lines []int32  `json:"lines,omitempty"`
 }
 
-func queryStack(ctx context.Context, db *sqlx.DB, repo *Repository, serviceName string) ([]Stack, error) {
+func queryStack(ctx context.Context, db *sqlx.DB, repo *Repository, serviceName string, filter SampleFilter) ([]Stack, error) {
 	var stacks []Stack
 
 	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
-		var dbStacks []struct {
-			DurationMillis int32          `db:"duration"`
-			MethodIds      types.JSONText `db:"methods"`
-		}
+		var dbStacks []dbStack
 
 		timeMin := 0
 		timeMax := time.Now().Unix()
@@ -137,7 +455,9 @@ func queryStack(ctx context.Context, db *sqlx.DB, repo *Repository, serviceName
             SELECT unnest(items) AS item
             FROM ap_sample
             WHERE instance_id = ANY(ap_instances_of($1))
-              AND timeslot BETWEEN $2 AND $3),
+              AND timeslot BETWEEN $2 AND $3
+              AND labels @> $4
+              AND ($5::TEXT = '' OR kind = $5)),
         
           merged AS (
             SELECT (item).stack_id as stack_id, sum((item).duration) as duration
@@ -146,40 +466,151 @@ func queryStack(ctx context.Context, db *sqlx.DB, repo *Repository, serviceName
         
           SELECT merged.duration as duration, stack.methods as methods
           FROM merged
-            JOIN ap_stack AS stack ON (merged.stack_id = stack.id);`, serviceName, timeMin, timeMax)
+            JOIN ap_stack AS stack ON (merged.stack_id = stack.id);`, serviceName, timeMin, timeMax, filter.Labels, filter.Kind)
 
-		// lookup table for method names
-		lookupTable := map[int32]string{}
+		if err != nil {
+			return errors.WithMessage(err, "query grouped samples")
+		}
 
-		for _, dbStack := range dbStacks {
-			var methodIds []int32
-			if err := dbStack.MethodIds.Unmarshal(&methodIds); err != nil {
-				return errors.WithMessage(err, "decode method ids")
-			}
+		stacks, err = stacksOf(ctx, repo, dbStacks)
+		return err
+	})
 
-			var methods []string
-			for _, id := range methodIds {
-				name, ok := lookupTable[id]
-				if !ok {
-					name, err = repo.MethodName(ctx, id)
-					if err != nil {
-						return errors.WithMessage(err, "lookup method name")
-					}
+	return stacks, err
+}
 
-					lookupTable[id] = name
-				}
+type dbStack struct {
+	DurationMillis int32          `db:"duration"`
+	MethodIds      types.JSONText `db:"methods"`
+}
 
-				methods = append(methods, name)
-			}
+// stacksOf resolves the method names of the given stacks.
+func stacksOf(ctx context.Context, repo *Repository, dbStacks []dbStack) ([]Stack, error) {
+	var stacks []Stack
 
-			stacks = append(stacks, Stack{
-				Methods:          methods,
-				DurationInMillis: dbStack.DurationMillis,
-			})
+	// lookup table for method names
+	lookupTable := map[int32]Method{}
+
+	for _, dbStack := range dbStacks {
+		methods, err := methodsOf(ctx, repo, lookupTable, dbStack.MethodIds)
+		if err != nil {
+			return nil, err
+		}
+
+		names, files, lines := splitMethods(methods)
+
+		stacks = append(stacks, Stack{
+			Methods:          names,
+			DurationInMillis: dbStack.DurationMillis,
+			Files:            files,
+			Lines:            lines,
+		})
+	}
+
+	return stacks, nil
+}
+
+type ValueStack struct {
+	Methods []string `json:"methods"`
+	Value   int64    `json:"value"`
+
+	// source file and line of each method, only
+	// set if the agent included line information.
+	Files []string `json:"files,omitempty"`
+	Lines []int32  `json:"lines,omitempty"`
+}
+
+// queryValueStack returns the stacks of a non cpu profile, like a heap profile,
+// with the sum of the given value type for each stack in the time range.
+// Goroutine profiles are snapshots, so only the latest snapshot of each
+// instance is included. The in-use values of heap profiles are the changes
+// since the previous window, so the in-use memory of an instance is the sum
+// of all its changes up to its latest window in the time range.
+func queryValueStack(ctx context.Context, db *sqlx.DB, repo *Repository, serviceName string, profileType, valueType string, timeMin, timeMax int64) ([]ValueStack, error) {
+	var stacks []ValueStack
+
+	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		var dbStacks []struct {
+			Value     int64          `db:"value"`
+			MethodIds types.JSONText `db:"methods"`
 		}
 
+		// the rows of ap_value_sample to include
+		samples := `
+				SELECT items
+				FROM ap_value_sample
+				WHERE instance_id = ANY(ap_instances_of($1))
+				  AND timeslot BETWEEN $2 AND $3
+				  AND profile_type = $4
+				  AND value_type = $5`
+
+		switch {
+		case profileType == "heap" && strings.HasPrefix(valueType, "inuse_"):
+			// all changes of the instances that were alive during the range
+			samples = `
+				SELECT items
+				FROM ap_value_sample
+				WHERE instance_id IN (
+						SELECT instance_id
+						FROM ap_value_sample
+						WHERE instance_id = ANY(ap_instances_of($1))
+						  AND timeslot BETWEEN $2 AND $3
+						  AND profile_type = $4
+						  AND value_type = $5)
+				  AND timeslot <= $3
+				  AND profile_type = $4
+				  AND value_type = $5`
+
+		case profileType == "goroutine":
+			// each row is a snapshot, take the latest one of each instance
+			samples = `
+				SELECT DISTINCT ON (instance_id) items
+				FROM ap_value_sample
+				WHERE instance_id = ANY(ap_instances_of($1))
+				  AND timeslot BETWEEN $2 AND $3
+				  AND profile_type = $4
+				  AND value_type = $5
+				ORDER BY instance_id, timeslot DESC`
+		}
+
+		err := tx.SelectContext(ctx, &dbStacks, `
+			WITH samples AS (`+samples+`),
+
+			samples_unnest AS (
+				SELECT unnest(items) AS item
+				FROM samples),
+
+			merged AS (
+				SELECT (item).stack_id as stack_id, sum((item).value) as value
+				FROM samples_unnest
+				GROUP BY (item).stack_id)
+
+			SELECT merged.value as value, stack.methods as methods
+			FROM merged
+				JOIN ap_stack AS stack ON (merged.stack_id = stack.id);`,
+			serviceName, timeMin, timeMax, profileType, valueType)
+
 		if err != nil {
-			return errors.WithMessage(err, "query grouped samples")
+			return errors.WithMessage(err, "query grouped value samples")
+		}
+
+		// lookup table for method names
+		lookupTable := map[int32]Method{}
+
+		for _, dbStack := range dbStacks {
+			methods, err := methodsOf(ctx, repo, lookupTable, dbStack.MethodIds)
+			if err != nil {
+				return err
+			}
+
+			names, files, lines := splitMethods(methods)
+
+			stacks = append(stacks, ValueStack{
+				Methods: names,
+				Value:   dbStack.Value,
+				Files:   files,
+				Lines:   lines,
+			})
 		}
 
 		return nil
@@ -187,3 +618,50 @@ func queryStack(ctx context.Context, db *sqlx.DB, repo *Repository, serviceName
 
 	return stacks, err
 }
+
+// methodsOf decodes the json encoded list of method ids and
+// resolves the methods using the lookup table and the
+// repository as fallback.
+func methodsOf(ctx context.Context, repo *Repository, lookupTable map[int32]Method, encodedMethodIds types.JSONText) ([]Method, error) {
+	var methodIds []int32
+	if err := encodedMethodIds.Unmarshal(&methodIds); err != nil {
+		return nil, errors.WithMessage(err, "decode method ids")
+	}
+
+	var methods []Method
+	for _, id := range methodIds {
+		method, ok := lookupTable[id]
+		if !ok {
+			var err error
+			method, err = repo.Method(ctx, id)
+			if err != nil {
+				return nil, errors.WithMessage(err, "lookup method")
+			}
+
+			lookupTable[id] = method
+		}
+
+		methods = append(methods, method)
+	}
+
+	return methods, nil
+}
+
+// splitMethods returns the names, files and lines of the given methods.
+// Files and lines are nil, if none of the methods has line information.
+func splitMethods(methods []Method) (names []string, files []string, lines []int32) {
+	var hasLines bool
+	for _, method := range methods {
+		names = append(names, method.Name)
+		hasLines = hasLines || method.File != ""
+	}
+
+	if hasLines {
+		for _, method := range methods {
+			files = append(files, method.File)
+			lines = append(lines, method.Line)
+		}
+	}
+
+	return names, files, lines
+}
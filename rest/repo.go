@@ -8,25 +8,33 @@ import (
 	"sync"
 )
 
+// Method is a method, or a line within a method if
+// the agent included line information.
+type Method struct {
+	Name string `db:"name"`
+	File string `db:"file"`
+	Line int32  `db:"line"`
+}
+
 type Repository struct {
 	methodCacheLock sync.Mutex
-	methodCache     map[int32]string
+	methodCache     map[int32]Method
 }
 
 func NewRepository() *Repository {
 	return &Repository{
-		methodCache: map[int32]string{},
+		methodCache: map[int32]Method{},
 	}
 }
 
 func (r *Repository) FillCache(ctx context.Context) error {
 	var values []struct {
-		Id   int32  `db:"id"`
-		Name string `db:"name"`
+		Method
+		Id int32 `db:"id"`
 	}
 
 	err := po.WithTransactionFromContext(ctx, func(tx *sqlx.Tx) error {
-		return tx.Select(&values, `SELECT id, name FROM ap_method`)
+		return tx.Select(&values, `SELECT id, name, file, line FROM ap_method`)
 	})
 
 	if err != nil {
@@ -36,28 +44,32 @@ func (r *Repository) FillCache(ctx context.Context) error {
 	r.methodCacheLock.Lock()
 	defer r.methodCacheLock.Unlock()
 	for _, value := range values {
-		r.methodCache[value.Id] = value.Name
+		r.methodCache[value.Id] = value.Method
 	}
 
 	return nil
 }
 
-func (r *Repository) MethodName(ctx context.Context, id int32) (string, error) {
+func (r *Repository) Method(ctx context.Context, id int32) (Method, error) {
 	r.methodCacheLock.Lock()
-	name, ok := r.methodCache[id]
+	method, ok := r.methodCache[id]
 	r.methodCacheLock.Unlock()
 
 	if ok {
-		return name, nil
+		return method, nil
 	}
 
 	err := po.WithTransactionFromContext(ctx, func(tx *sqlx.Tx) error {
-		return tx.GetContext(ctx, &name, `SELECT name FROM ap_method WHERE id=$1`, id)
+		return tx.GetContext(ctx, &method, `SELECT name, file, line FROM ap_method WHERE id=$1`, id)
 	})
 
+	if err != nil {
+		return method, errors.WithMessage(err, "lookup method")
+	}
+
 	r.methodCacheLock.Lock()
-	r.methodCache[id] = name
+	r.methodCache[id] = method
 	r.methodCacheLock.Unlock()
 
-	return name, errors.WithMessage(err, "lookup method name")
+	return method, nil
 }
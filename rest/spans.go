@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	ht "github.com/flachnetz/startup/startup_http"
+	po "github.com/flachnetz/startup/startup_postgres"
+	"github.com/jmoiron/sqlx"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SpanFilter restricts the spans that are included in a query.
+type SpanFilter struct {
+	// the name of the spans, e.g. an endpoint. Empty for all spans.
+	Name string
+
+	// the trace the spans belong to. Empty for all traces.
+	TraceId string
+
+	// only spans that took at least this long are included.
+	MinDuration time.Duration
+}
+
+// spanFilterOf parses the span filter of the request. The name of the span
+// is given by the "span" query parameter, the minimum duration of the spans
+// by the "minDurationMs" parameter. The trace id is taken from the path.
+func spanFilterOf(request *http.Request, params httprouter.Params) (SpanFilter, error) {
+	query := request.URL.Query()
+
+	filter := SpanFilter{
+		Name:    query.Get("span"),
+		TraceId: params.ByName("trace"),
+	}
+
+	if value := query.Get("minDurationMs"); value != "" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || millis < 0 {
+			return SpanFilter{}, fmt.Errorf("invalid minimum duration '%s'", value)
+		}
+
+		filter.MinDuration = time.Duration(millis) * time.Millisecond
+	}
+
+	return filter, nil
+}
+
+// HandlerSpans serves the slowest spans of a service. Each span links a
+// trace id to the cpu time of the samples recorded while the span ran.
+func HandlerSpans(db *sqlx.DB) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
+			filter, err := spanFilterOf(request, params)
+			if err != nil {
+				return nil, err
+			}
+
+			return querySpans(request.Context(), db, opts.Service, filter, 100)
+		})
+	}
+}
+
+// HandlerSpanStack serves the stacks of the samples recorded during the spans
+// matching the filter, e.g. the cpu profile of the slow requests of an
+// endpoint, or of a single trace.
+func HandlerSpanStack(db *sqlx.DB, repo *Repository) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		var opts struct {
+			Service string `validate:"required" path:"service"`
+		}
+
+		ht.ExtractAndCall(&opts, writer, request, params, func() (interface{}, error) {
+			filter, err := spanFilterOf(request, params)
+			if err != nil {
+				return nil, err
+			}
+
+			return querySpanStack(request.Context(), db, repo, opts.Service, filter)
+		})
+	}
+}
+
+type Span struct {
+	TraceId          string    `json:"traceId" db:"trace_id"`
+	SpanId           string    `json:"spanId" db:"span_id"`
+	Name             string    `json:"name" db:"name"`
+	StartTime        time.Time `json:"startTime" db:"start_time"`
+	DurationInMillis float64   `json:"durationInMillis" db:"duration"`
+
+	// the cpu time of the samples recorded during the span
+	CPUTimeInMillis int64 `json:"cpuTimeInMillis" db:"cpu_time"`
+}
+
+// querySpans returns the slowest spans matching the filter.
+func querySpans(ctx context.Context, db *sqlx.DB, serviceName string, filter SpanFilter, limit int) ([]Span, error) {
+	var spans []Span
+
+	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &spans, `
+			SELECT span.trace_id, span.span_id, span.name, span.start_time,
+					span.duration_ns / 1e6 as duration,
+					COALESCE((
+						SELECT sum(sample.duration_ns) / 1000000
+						FROM ap_span_sample AS sample
+						WHERE sample.trace_id = span.trace_id AND sample.span_id = span.span_id), 0)::INT8 as cpu_time
+			FROM ap_span AS span
+			WHERE span.instance_id = ANY(ap_instances_of($1))
+				AND ($2::TEXT = '' OR span.name = $2)
+				AND ($3::TEXT = '' OR span.trace_id = $3)
+				AND span.duration_ns >= $4
+			ORDER BY span.duration_ns DESC
+			LIMIT $5`,
+			serviceName, filter.Name, filter.TraceId, int64(filter.MinDuration), limit)
+	})
+
+	return spans, errors.WithMessage(err, "query spans")
+}
+
+// querySpanStack returns the stacks of the samples recorded during the spans
+// matching the filter. If a minimum duration is given, only the samples of
+// spans that were sent by the agents are included, as the agents only
+// send the slowest spans of each window.
+func querySpanStack(ctx context.Context, db *sqlx.DB, repo *Repository, serviceName string, filter SpanFilter) ([]Stack, error) {
+	var stacks []Stack
+
+	err := po.WithTransactionContext(ctx, db, func(ctx context.Context, tx *sqlx.Tx) error {
+		var dbStacks []dbStack
+
+		err := tx.SelectContext(ctx, &dbStacks, `
+			WITH merged AS (
+				SELECT sample.stack_id as stack_id, sum(sample.duration_ns) / 1000000 as duration
+				FROM ap_span_sample AS sample
+					LEFT JOIN ap_span AS span ON (span.trace_id = sample.trace_id AND span.span_id = sample.span_id)
+				WHERE sample.instance_id = ANY(ap_instances_of($1))
+					AND ($2::TEXT = '' OR sample.span = $2)
+					AND ($3::TEXT = '' OR sample.trace_id = $3)
+					AND ($4::INT8 = 0 OR span.duration_ns >= $4)
+				GROUP BY sample.stack_id)
+
+			SELECT merged.duration::INT4 as duration, stack.methods as methods
+			FROM merged
+				JOIN ap_stack AS stack ON (merged.stack_id = stack.id)`,
+			serviceName, filter.Name, filter.TraceId, int64(filter.MinDuration))
+
+		if err != nil {
+			return errors.WithMessage(err, "query span samples")
+		}
+
+		stacks, err = stacksOf(ctx, repo, dbStacks)
+		return err
+	})
+
+	return stacks, err
+}
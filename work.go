@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/flachnetz/alwaysprofile/pprof"
 	"github.com/flachnetz/alwaysprofile/pprof/sender"
@@ -29,7 +30,17 @@ func main() {
 		}),
 	}
 
-	defer pprof.Start(config).Stop()
+	profiler, err := pprof.Start(config)
+	if err != nil {
+		panic(err)
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_ = profiler.Stop(ctx)
+	}()
 
 	http.DefaultClient.Transport = &http.Transport{
 		MaxConnsPerHost:     128,